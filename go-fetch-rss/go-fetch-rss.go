@@ -1,17 +1,180 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type Config struct {
+	URL                   string     `json:"url"`
+	URLsFile              string     `json:"urlsFile"`
+	OutputDir             string     `json:"outputDir"`
+	FileExtension         string     `json:"fileExtension"`
+	RedirectFileExtension string     `json:"redirectFileExtension"`
+	TargetDate            string     `json:"date"`
+	DryRun                dryRunMode `json:"dryRun"`
+	Verbose               bool       `json:"verbose"`
+	Timeout               duration   `json:"timeout"`
+	Timezone              string     `json:"tz"`
+	Progress              bool       `json:"progress"`
+	Manifest              string     `json:"manifest"`
+	Report                string     `json:"report"`
+	Match                 string     `json:"match"`
+	Exclude               string     `json:"exclude"`
+	State                 string     `json:"state"`
+	Headers               []string   `json:"headers"`
+	BasicAuth             string     `json:"basicAuth"`
+	Limit                 int        `json:"limit"`
+	PreferEnclosure       bool       `json:"preferEnclosure"`
+	CaptureSchemes        string     `json:"captureRedirectSchemes"`
+	Proxy                 string     `json:"proxy"`
+	RedirectFormat        string     `json:"redirectFormat"`
+	FileMode              fileMode   `json:"fileMode"`
+	DirMode               fileMode   `json:"dirMode"`
+	DateSubdir            bool       `json:"dateSubdir"`
+	Contains              []string   `json:"contains"`
+	NotContains           []string   `json:"notContains"`
+	JSON                  bool       `json:"json"`
+	Retries               int        `json:"retries"`
+	DB                    string     `json:"db"`
+	UserAgent             string     `json:"userAgent"`
+}
+
+// stringList is a flag that can be given more than once, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// dryRunMode is the -dry-run value. As well as true or false it accepts "head", which sends a
+// HEAD request for each matching item to report its size without downloading it.
+type dryRunMode string
+
+const (
+	dryRunOff  dryRunMode = "false"
+	dryRunOn   dryRunMode = "true"
+	dryRunHead dryRunMode = "head"
 )
 
+func (m *dryRunMode) String() string {
+	return string(*m)
+}
+
+func (m *dryRunMode) Set(value string) error {
+	if strings.EqualFold(value, string(dryRunHead)) {
+		*m = dryRunHead
+		return nil
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("must be true, false, or head")
+	}
+
+	*m = dryRunOff
+	if enabled {
+		*m = dryRunOn
+	}
+	return nil
+}
+
+// IsBoolFlag lets "-dry-run" be given on its own, meaning true.
+func (m *dryRunMode) IsBoolFlag() bool {
+	return true
+}
+
+// UnmarshalJSON accepts both the original boolean form and the "head" string in config files.
+func (m *dryRunMode) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+
+	return m.Set(fmt.Sprint(value))
+}
+
+// enabled reports whether downloads are skipped.
+func (m dryRunMode) enabled() bool {
+	return m != dryRunOff
+}
+
+// fileMode is an os.FileMode given in octal, e.g. "0644", on the command line or in the config file.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(value string) error {
+	v, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("%q is not an octal permission such as 0644", value)
+	}
+
+	*m = fileMode(v)
+	return nil
+}
+
+func (m *fileMode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	return m.Set(s)
+}
+
+// duration is a time.Duration that decodes from strings such as "30s" in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
 type Response struct {
 	Ch Channel `xml:"channel"`
 }
@@ -22,53 +185,298 @@ type Channel struct {
 }
 
 type Item struct {
-	Title       string `xml:"title"`
-	Guid        string `xml:"guid"`
-	PublishDate string `xml:"pubDate"`
-	Link        string `xml:"link"`
+	Title       string     `xml:"title" json:"title"`
+	Guid        string     `xml:"guid" json:"guid"`
+	PublishDate string     `xml:"pubDate" json:"pubDate"`
+	Link        string     `xml:"link" json:"link"`
+	Enclosure   *Enclosure `xml:"enclosure" json:"enclosure,omitempty"`
+}
+
+// JSONFeed is the part of a JSON Feed (https://jsonfeed.org) document that maps onto Item.
+type JSONFeed struct {
+	Title string         `json:"title"`
+	Items []JSONFeedItem `json:"items"`
+}
+
+type JSONFeedItem struct {
+	ID            string               `json:"id"`
+	Title         string               `json:"title"`
+	URL           string               `json:"url"`
+	ExternalURL   string               `json:"external_url"`
+	DatePublished string               `json:"date_published"`
+	Attachments   []JSONFeedAttachment `json:"attachments"`
+}
+
+type JSONFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+// ReportEntry is the outcome of one item, written to the -report.
+type ReportEntry struct {
+	Title    string `json:"title"`
+	Guid     string `json:"guid"`
+	URL      string `json:"url"`
+	Filename string `json:"filename,omitempty"`
+	Status   string `json:"status"`
+	Bytes    int64  `json:"bytes"`
+	Reason   string `json:"reason,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Enclosure is the media file attached to an item, used by podcast and video feeds.
+type Enclosure struct {
+	URL    string `xml:"url,attr" json:"url"`
+	Type   string `xml:"type,attr" json:"type,omitempty"`
+	Length int64  `xml:"length,attr" json:"length,omitempty"`
 }
 
 const dateFormat = "2006-01-02"
 
+// version is reported in the default User-Agent.
+const version = "1.0"
+
+const defaultUserAgent = "go-fetch-rss/" + version + " (+https://github.com/JoeEcob/go-files)"
+
+// retryBackoff is the wait before the first retry, doubling on each one after.
+const retryBackoff = time.Second
+
+// maxRetryAfter caps how long a server's Retry-After can make us wait.
+const maxRetryAfter = 5 * time.Minute
+
+// autoExtension is the -ext value that derives each file's extension from the response.
+const autoExtension = "auto"
+
+// fallbackExtension is used with -ext auto when the content type can't be determined.
+const fallbackExtension = "file"
+
+// Item outcomes recorded in the -report.
+const (
+	reportDownloaded = "downloaded"
+	reportRedirect   = "redirect"
+	reportSkipped    = "skipped"
+	reportError      = "error"
+)
+
+// Formats for the file written when a redirect is captured.
+const (
+	redirectFormatRaw     = "raw"
+	redirectFormatURL     = "url"
+	redirectFormatDesktop = "desktop"
+)
+
+// preferredExtensions picks the usual extension for types where mime.ExtensionsByType
+// returns several in alphabetical order, e.g. ".jfif" before ".jpg".
+var preferredExtensions = map[string]string{
+	"audio/mpeg": "mp3",
+	"audio/mp4":  "m4a",
+	"image/jpeg": "jpg",
+	"text/html":  "html",
+	"text/plain": "txt",
+	"video/mp4":  "mp4",
+}
+
+// publishDateLayouts are the pubDate formats tried in order, covering the RFC 822
+// variants seen in the wild as well as feeds that use RFC 3339.
+var publishDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+}
+
 func main() {
-	url := flag.String("url", "", "The URL to call to fetch RSS data including API key and search query.")
-	outputDir := flag.String("out", ".", "Path to output directory.")
-	fileExtension := flag.String("ext", "file", "File extension name to use.")
-	redirectFileExtension := flag.String("redir-ext", "redirect", "Redirect file extension name to use.")
-	targetDate := flag.String("date", time.Now().Format(dateFormat), "Date to find results from e.g. '2006-01-02'.")
-	dryRun := flag.Bool("dry-run", true, "Flag to set dry-run mode.")
-	verbose := flag.Bool("verbose", false, "Flag to set dry-run mode.")
+	config := &Config{}
+
+	var headers, contains, notContains stringList
+	flag.Var(&headers, "header", "Header as 'Key: Value' sent with every request, can be repeated.")
+	flag.Var(&contains, "contains", "Only process items whose title contains this keyword, ignoring case. Can be repeated to allow any of several.")
+	flag.Var(&notContains, "not-contains", "Skip items whose title contains this keyword, ignoring case. Can be repeated.")
+
+	configFile := flag.String("config", "", "Path to an optional JSON configuration file. Explicit flags override its values.")
+	flag.StringVar(&config.URL, "url", "", "The URL to call to fetch RSS data including API key and search query.")
+	flag.StringVar(&config.URLsFile, "urls-file", "", "Path to a file of feed URLs, one per line. Used alongside -url.")
+	flag.StringVar(&config.OutputDir, "out", ".", "Path to output directory.")
+	flag.StringVar(&config.FileExtension, "ext", "file", "File extension name to use, or 'auto' to detect it from the response.")
+	flag.StringVar(&config.RedirectFileExtension, "redir-ext", "redirect", "Redirect file extension name to use.")
+	flag.StringVar(&config.TargetDate, "date", time.Now().Format(dateFormat), "Date to find results from e.g. '2006-01-02'.")
+	config.DryRun = dryRunOn
+	flag.Var(&config.DryRun, "dry-run", "Flag to set dry-run mode, or 'head' to also request each item's size and type without downloading it.")
+	flag.BoolVar(&config.Verbose, "verbose", false, "Flag to set verbose mode.")
+	flag.DurationVar((*time.Duration)(&config.Timeout), "timeout", 30*time.Second, "Timeout for each feed request, and for connecting and receiving response headers when downloading items, e.g. '30s'.")
+	flag.BoolVar(&config.Progress, "progress", false, "Flag to report download progress to stderr.")
+	flag.StringVar(&config.Manifest, "manifest", "", "Path to a SHA256SUMS style manifest updated with each downloaded file.")
+	flag.StringVar(&config.Report, "report", "", "Path to write a JSON array of each item's outcome to: downloaded, redirect, skipped, or error.")
+	flag.StringVar(&config.Match, "match", "", "Regular expression item titles must match to be processed.")
+	flag.StringVar(&config.Exclude, "exclude", "", "Regular expression for item titles to skip.")
+	flag.StringVar(&config.State, "state", "", "Path to a JSON state file recording fetched items so they aren't downloaded again.")
+	flag.StringVar(&config.BasicAuth, "basic-auth", "", "Credentials as 'user:pass' sent with every request.")
+	flag.IntVar(&config.Limit, "limit", 0, "Maximum number of items to download per run, 0 for no limit.")
+	flag.BoolVar(&config.PreferEnclosure, "prefer-enclosure", true, "Flag to download an item's enclosure URL instead of its link when present.")
+	flag.StringVar(&config.CaptureSchemes, "capture-redirect-schemes", "", "Comma separated URL schemes, e.g. 'magnet,rtsp', whose redirect targets are written to a file instead of followed. Defaults to the -redir-ext value.")
+	flag.StringVar(&config.Proxy, "proxy", "", "Proxy URL for all requests, overrides the HTTP_PROXY/HTTPS_PROXY environment variables.")
+	flag.StringVar(&config.RedirectFormat, "redirect-format", redirectFormatRaw, "Format for captured redirect files: 'raw' (just the URL, using -redir-ext), 'url' (Windows shortcut), or 'desktop' (Linux desktop entry).")
+	config.FileMode = 0644
+	config.DirMode = 0755
+	flag.Var(&config.FileMode, "file-mode", "Octal permissions for written files.")
+	flag.Var(&config.DirMode, "dir-mode", "Octal permissions for created output directories.")
+	flag.BoolVar(&config.DateSubdir, "date-subdir", false, "Flag to write each item into a YYYY-MM-DD subdirectory of -out named after its publish date.")
+	flag.BoolVar(&config.JSON, "json", false, "Flag to print the matching items as a JSON array to stdout instead of downloading them.")
+	flag.IntVar(&config.Retries, "retries", 2, "Times to retry a request after a connection error, timeout, 429, or 5xx response.")
+	flag.StringVar(&config.DB, "db", "", "Path to a BoltDB index of fetched items, used to skip items and duplicate content across runs.")
+	flag.StringVar(&config.UserAgent, "user-agent", defaultUserAgent, "User-Agent sent with every request. Some servers block non-browser agents, so a browser-like value may be needed.")
+	flag.StringVar(&config.Timezone, "tz", "UTC", "IANA time zone used to match publish dates to -date, e.g. 'Europe/London'.")
 
 	flag.Parse()
 
-	if *url == "" {
+	if *configFile != "" {
+		if err := readConfig(flag.CommandLine, *configFile, config); err != nil {
+			fmt.Printf("Error reading configuration: %s\n", err)
+			return
+		}
+	}
+
+	// Repeatable flags add to the lists from the config file.
+	config.Headers = append(config.Headers, headers...)
+	config.Contains = append(config.Contains, contains...)
+	config.NotContains = append(config.NotContains, notContains...)
+
+	header, err := parseHeaders(config.Headers)
+	if err != nil {
+		fmt.Printf("Error, invalid header: %s\n", err)
+		return
+	}
+
+	if config.BasicAuth != "" && !strings.Contains(config.BasicAuth, ":") {
+		fmt.Println("Error, -basic-auth must be in the form 'user:pass'.")
+		return
+	}
+
+	switch config.RedirectFormat {
+	case redirectFormatRaw, redirectFormatURL, redirectFormatDesktop:
+	default:
+		fmt.Printf("Error, unknown redirect format %q.\n", config.RedirectFormat)
+		return
+	}
+
+	loc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		fmt.Printf("Error, invalid time zone %q: %s\n", config.Timezone, err)
+		return
+	}
+
+	match, err := compileRegexp(config.Match)
+	if err != nil {
+		fmt.Printf("Error, invalid -match expression: %s\n", err)
+		return
+	}
+
+	exclude, err := compileRegexp(config.Exclude)
+	if err != nil {
+		fmt.Printf("Error, invalid -exclude expression: %s\n", err)
+		return
+	}
+
+	urls, err := feedURLs(config)
+	if err != nil {
+		fmt.Printf("Error reading URLs file: %s\n", err)
+		return
+	}
+
+	if len(urls) == 0 {
 		fmt.Println("Error, URL is required.")
 		return
 	}
 
-	fmt.Printf("go-fetch-rss DryRun: %t Date: %s OutputDir: %s FileExtension: %s URL: %s\n", *dryRun, *targetDate, *outputDir, *fileExtension, *url)
+	state, err := loadState(config.State)
+	if err != nil {
+		fmt.Printf("Error reading state file: %s\n", err)
+		return
+	}
+
+	// Everything else printed is progress, so in JSON mode send it to stderr and keep stdout for the items.
+	var out io.Writer = os.Stdout
+	if config.JSON {
+		out = os.Stderr
+	}
+
+	if !config.DryRun.enabled() && !config.JSON {
+		if err := os.MkdirAll(config.OutputDir, os.FileMode(config.DirMode)); err != nil {
+			fmt.Fprintf(out, "Error creating output directory: %s\n", err)
+			return
+		}
+	}
+
+	fmt.Fprintf(out, "go-fetch-rss DryRun: %s Date: %s OutputDir: %s FileExtension: %s Feeds: %d\n", config.DryRun, config.TargetDate, config.OutputDir, config.FileExtension, len(urls))
+
+	var idx *index
+	if config.DB != "" {
+		idx, err = openIndex(config.DB)
+		if err != nil {
+			fmt.Fprintf(out, "Error opening database: %s\n", err)
+			return
+		}
+		defer idx.Close()
+	}
 
-	res, err := http.Get(*url)
-	if res.StatusCode != 200 {
-		fmt.Printf("Error fetching! %s", err)
+	transport, err := newTransport(config.Proxy)
+	if err != nil {
+		fmt.Fprintf(out, "Error, invalid proxy: %s\n", err)
 		return
 	}
 
-	resBody, _ := io.ReadAll(res.Body)
+	f := &fetcher{
+		config:     config,
+		out:        out,
+		location:   loc,
+		match:      match,
+		exclude:    exclude,
+		state:      state,
+		index:      idx,
+		header:     header,
+		checksums:  map[string]string{},
+		matched:    []*Item{},
+		report:     []ReportEntry{},
+		feedClient: &http.Client{Transport: transport, Timeout: time.Duration(config.Timeout)},
+	}
 
-	var r Response
-	xml.Unmarshal(resBody, &r)
+	// Redirects to these schemes can't be fetched, so the target is captured to a file instead.
+	// Older configs used the redirect file extension as the scheme, keep that as the default.
+	captureSchemes := map[string]bool{}
+	for _, scheme := range strings.Split(config.CaptureSchemes, ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			captureSchemes[scheme] = true
+		}
+	}
+	if len(captureSchemes) == 0 {
+		captureSchemes[strings.ToLower(config.RedirectFileExtension)] = true
+	}
 
-	fmt.Printf("Found %d items, starting download...\n", len(r.Ch.Items))
+	// Downloads of large enclosures can take far longer than -timeout, so rather than bound
+	// the whole request it only limits connecting and waiting for the response headers.
+	itemTransport := transport.Clone()
+	itemTransport.DialContext = (&net.Dialer{Timeout: time.Duration(config.Timeout), KeepAlive: 30 * time.Second}).DialContext
+	itemTransport.TLSHandshakeTimeout = time.Duration(config.Timeout)
+	itemTransport.ResponseHeaderTimeout = time.Duration(config.Timeout)
 
-	// Create a custom client to catch redirects. Without this we get an "error supported protocol".
-	client := http.Client{
+	// Create a custom client to catch redirects. Without this we get an "unsupported protocol scheme" error.
+	f.itemClient = &http.Client{
+		Transport: itemTransport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			loc, _ := req.Response.Location()
+			// Stop following and hand the redirect response back, downloadItem writes its target.
+			if captureSchemes[req.URL.Scheme] {
+				return http.ErrUseLastResponse
+			}
 
-			// If the scheme matches our wanted redir file ext, return an error to stop the follow.
-			if loc != nil && loc.Scheme == *redirectFileExtension {
-				return errors.New("caught redirect")
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
 			}
 
 			// Otherwise return nil, to follow the redirect
@@ -76,53 +484,1324 @@ func main() {
 		},
 	}
 
-	for _, item := range r.Ch.Items {
-		// e.g. "Thu, 11 Jan 2024 21:00:00 +0000"
-		t, e := time.Parse("Mon, 2 Jan 2006 15:04:05 +0000", item.PublishDate)
-		if e != nil {
-			fmt.Printf("Err parsing time: %s %s\n", item.Title, e)
+	// Stop cleanly on Ctrl-C, finishing with the summary of what completed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Process each feed in turn, a failure in one shouldn't stop the others.
+	var results []*feedResult
+	for _, feedURL := range urls {
+		if ctx.Err() != nil {
+			break
+		}
+		results = append(results, f.processFeed(ctx, feedURL))
+	}
+
+	if ctx.Err() != nil {
+		fmt.Fprintln(out, "Interrupted, stopping early.")
+	}
+
+	total := &feedResult{}
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Fprintf(out, "Feed %s: error: %s\n", result.URL, result.Err)
+			total.Errors++
 			continue
 		}
+		fmt.Fprintf(out, "Feed %s: found %d matched %d downloaded %d\n", result.URL, result.Found, result.Matched, result.Downloaded)
+
+		total.Matched += result.Matched
+		total.Downloaded += result.Downloaded
+		total.Redirects += result.Redirects
+		total.Skipped += result.Skipped
+		total.Errors += result.Errors
+		total.HeadBytes += result.HeadBytes
+	}
+
+	if config.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(f.matched); err != nil {
+			fmt.Fprintf(out, "Error writing JSON: %s\n", err)
+		}
+	}
+
+	if config.DryRun == dryRunHead {
+		fmt.Fprintf(out, "Estimated download size: %d bytes\n", total.HeadBytes)
+	}
+
+	if config.State != "" {
+		if err := state.save(config.State); err != nil {
+			fmt.Fprintf(out, "Error writing state file: %s\n", err)
+		}
+	}
+
+	// Written whatever happened, so a partly failed run still shows which items to retry.
+	if config.Report != "" {
+		if err := writeReport(config.Report, f.report, os.FileMode(config.FileMode)); err != nil {
+			fmt.Fprintf(out, "Error writing report: %s\n", err)
+		}
+	}
+
+	if config.Manifest != "" && len(f.checksums) > 0 {
+		if err := writeManifest(config.Manifest, f.checksums, os.FileMode(config.FileMode)); err != nil {
+			fmt.Fprintf(out, "Error writing manifest: %s\n", err)
+		}
+	}
+
+	// Keep this on one line of key=value pairs so it's easy to grep from cron logs.
+	fmt.Fprintf(out, "Done all! feeds=%d matched=%d downloaded=%d redirects=%d skipped=%d errors=%d\n", len(results), total.Matched, total.Downloaded, total.Redirects, total.Skipped, total.Errors)
+}
+
+// newTransport returns the transport shared by both clients, using proxyURL when set and
+// the standard proxy environment variables otherwise.
+func newTransport(proxyURL string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("%q must be an absolute URL such as 'http://proxy:3128'", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return transport, nil
+}
+
+// State is persisted between runs with -state to remember which items have been fetched.
+type State struct {
+	// Items maps an item's GUID (or link, when it has none) to when it was fetched.
+	Items map[string]time.Time `json:"items"`
+
+	// Feeds maps a feed URL to the validators for a conditional GET on the next run.
+	Feeds map[string]FeedCache `json:"feeds"`
+}
+
+// FeedCache holds the ETag and Last-Modified headers from a feed's last response, and
+// the -date they were stored for.
+type FeedCache struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Date         string `json:"date,omitempty"`
+}
+
+// loadState reads the state file, a missing file gives an empty state.
+func loadState(filePath string) (*State, error) {
+	state := &State{Items: map[string]time.Time{}, Feeds: map[string]FeedCache{}}
+	if filePath == "" {
+		return state, nil
+	}
+
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(state); err != nil {
+		return nil, fmt.Errorf("error decoding state JSON: %v", err)
+	}
 
-		if *targetDate != t.Format(dateFormat) {
-			if *verbose {
-				fmt.Printf("Skipping, date mismatch: %s %s\n", item.Title, t.Format(dateFormat))
+	if state.Items == nil {
+		state.Items = map[string]time.Time{}
+	}
+	if state.Feeds == nil {
+		state.Feeds = map[string]FeedCache{}
+	}
+
+	return state, nil
+}
+
+// save writes the state via a temporary file so an interrupted run can't truncate it.
+func (s *State) save(filePath string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filePath)
+}
+
+// index is the optional -db BoltDB store of fetched items. Entries are keyed by GUID, with a
+// second bucket mapping content hashes back to GUIDs so duplicate files can be spotted.
+type index struct {
+	db *bolt.DB
+}
+
+// indexEntry is the JSON value stored for each fetched item.
+type indexEntry struct {
+	Path      string    `json:"path"`
+	SHA256    string    `json:"sha256,omitempty"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+var (
+	itemsBucket  = []byte("items")
+	hashesBucket = []byte("hashes")
+)
+
+// openIndex opens or creates the database, giving up if another run holds the lock.
+func openIndex(filePath string) (*index, error) {
+	db, err := bolt.Open(filePath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{itemsBucket, hashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
 			}
-			continue
 		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-		if *dryRun {
-			fmt.Printf("Skipping download, dry run enabled %s\n%s\n", item.Title, item.Link)
-			continue
+	return &index{db: db}, nil
+}
+
+func (i *index) Close() error {
+	return i.db.Close()
+}
+
+// lookup returns the entry for key, or nil if it hasn't been fetched.
+func (i *index) lookup(key string) (*indexEntry, error) {
+	var entry *indexEntry
+	err := i.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(itemsBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		data := bucket.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+
+		entry = &indexEntry{}
+		return json.Unmarshal(data, entry)
+	})
+
+	return entry, err
+}
+
+// lookupHash returns the entry of an item already fetched with the given content hash.
+func (i *index) lookupHash(sum string) (*indexEntry, error) {
+	var key []byte
+	err := i.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hashesBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		// Values are only valid inside the transaction, so take a copy.
+		if v := bucket.Get([]byte(sum)); v != nil {
+			key = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, nil
+	}
+
+	return i.lookup(string(key))
+}
+
+// record stores entry under key, and indexes its hash when it has one.
+func (i *index) record(key string, entry indexEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(itemsBucket).Put([]byte(key), data); err != nil {
+			return err
+		}
+
+		if entry.SHA256 == "" {
+			return nil
+		}
+
+		// Keep the first item seen with this content as the original.
+		hashes := tx.Bucket(hashesBucket)
+		if hashes.Get([]byte(entry.SHA256)) != nil {
+			return nil
+		}
+		return hashes.Put([]byte(entry.SHA256), []byte(key))
+	})
+}
+
+// feedResult holds the per-feed counts reported at the end of a run.
+type feedResult struct {
+	URL        string
+	Found      int
+	Matched    int
+	Downloaded int
+	Redirects  int
+	Skipped    int
+	Errors     int
+	Err        error
+
+	// HeadBytes totals the Content-Length reported for items in -dry-run=head mode.
+	HeadBytes int64
+}
+
+// fetcher holds the configuration and HTTP clients shared by every feed in a run.
+type fetcher struct {
+	config     *Config
+	feedClient *http.Client
+	itemClient *http.Client
+	location   *time.Location
+	match      *regexp.Regexp
+	exclude    *regexp.Regexp
+	state      *State
+	index      *index
+	header     http.Header
+
+	// out receives progress and log messages, stderr with -json so stdout only has the items.
+	out io.Writer
+
+	// checksums maps each file downloaded this run to its hex SHA-256.
+	checksums map[string]string
+
+	// matched collects the items that passed the filters, for -json.
+	matched []*Item
+
+	// report collects every item's outcome, for -report.
+	report []ReportEntry
+
+	// fetched counts items downloaded or redirects written across all feeds, for -limit.
+	fetched int
+}
+
+// processFeed fetches a single feed and downloads the items matching the target date.
+func (f *fetcher) processFeed(ctx context.Context, feedURL string) *feedResult {
+	config := f.config
+	result := &feedResult{URL: feedURL}
+
+	fmt.Fprintf(f.out, "Fetching %s\n", feedURL)
+
+	req, err := f.newRequest(ctx, http.MethodGet, feedURL)
+	if err != nil {
+		result.Err = fmt.Errorf("error creating feed request: %v", err)
+		return result
+	}
+
+	// Only ask for changes when the state file is kept, otherwise there's nothing to compare against.
+	// A feed unchanged since a run for another date can still have items for this one.
+	if cache := f.state.Feeds[feedURL]; config.State != "" && cache.Date == config.TargetDate {
+		if cache.ETag != "" {
+			req.Header.Set("If-None-Match", cache.ETag)
 		}
+		if cache.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cache.LastModified)
+		}
+	}
+
+	// Asking for gzip ourselves turns off the transport's transparent decompression, so
+	// readFeedBody handles it along with feeds that are published as .gz files.
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := f.do(ctx, f.feedClient, req)
+	if err != nil {
+		result.Err = fmt.Errorf("error fetching feed: %v", err)
+		return result
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		fmt.Fprintf(f.out, "Feed not modified since last run, skipping %s\n", feedURL)
+		return result
+	}
+
+	resBody, err := readFeedBody(res)
+	if err != nil {
+		result.Err = fmt.Errorf("error reading feed response body: %v", err)
+		return result
+	}
+
+	if res.StatusCode != http.StatusOK {
+		result.Err = fmt.Errorf("error fetching feed: %s %s", res.Status, truncate(strings.TrimSpace(string(resBody)), 200))
+		return result
+	}
+
+	items, err := parseFeed(feedURL, res.Header.Get("Content-Type"), resBody)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	// Relative links are resolved against where the feed was actually served from.
+	resolveLinks(res.Request.URL, items)
+
+	result.Found = len(items)
+	fmt.Fprintf(f.out, "Found %d items, starting download...\n", len(items))
+
+	// Some feeds list the same item more than once, only process the first.
+	seen := map[string]bool{}
+
+	// Set when an item is deliberately left for a later run.
+	deferred := false
+
+	// Items whose date can't be parsed won't match on any run, so they don't hold back the validators.
+	unparsed := 0
 
-		fmt.Printf("Doing %s\n", item.Title)
+	for _, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
 
-		itemRes, err := client.Get(item.Link)
+		key := item.Guid
+		if key == "" {
+			key = item.Link
+		}
 
-		// Handle redirects by saving the URL to a file
-		if err != nil && itemRes != nil && itemRes.StatusCode == http.StatusFound {
-			loc, _ := itemRes.Location()
-			fmt.Printf("Got 302. Writing %s\n", loc)
-			os.WriteFile(path.Join(*outputDir, fmt.Sprintf("%s.%s", item.Title, *redirectFileExtension)), []byte(loc.String()), 0666)
+		if seen[key] {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, duplicate item: %s %s\n", item.Title, key)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "duplicate item"})
 			continue
 		}
+		seen[key] = true
 
-		// Every other error is unknown so exit
-		if err != nil {
-			fmt.Printf("Error fetching: %s err: %s\n", item.Title, err)
+		if f.match != nil && !f.match.MatchString(item.Title) {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, title doesn't match %q: %s\n", config.Match, item.Title)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "title doesn't match -match"})
 			continue
 		}
 
-		// Otherwise fetch the actual file
-		if itemRes.StatusCode == http.StatusOK {
-			fmt.Printf("Writing %s\n", item.Title)
-			bytes, _ := io.ReadAll(itemRes.Body)
-			os.WriteFile(path.Join(*outputDir, fmt.Sprintf("%s.%s", item.Title, *fileExtension)), bytes, 0666)
+		if f.exclude != nil && f.exclude.MatchString(item.Title) {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, title matches exclude %q: %s\n", config.Exclude, item.Title)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "title matches -exclude"})
+			continue
 		}
 
-		fmt.Printf("Done %s\n", item.Title)
+		if _, ok := containsAny(item.Title, config.Contains); len(config.Contains) > 0 && !ok {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, title doesn't contain any of %q: %s\n", config.Contains, item.Title)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "title doesn't contain any -contains keyword"})
+			continue
+		}
+
+		if keyword, ok := containsAny(item.Title, config.NotContains); ok {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, title contains %q: %s\n", keyword, item.Title)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "title contains -not-contains keyword " + strconv.Quote(keyword)})
+			continue
+		}
+
+		t, e := parsePublishDate(item.PublishDate)
+		if e != nil {
+			fmt.Fprintf(f.out, "Err parsing time: %s %s\n", item.Title, e)
+			result.Errors++
+			unparsed++
+			f.addReport(item, ReportEntry{Status: reportError, Error: e.Error()})
+			continue
+		}
+
+		// Compare against the target date in the configured time zone, not the feed's offset.
+		t = t.In(f.location)
+
+		if config.TargetDate != t.Format(dateFormat) {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, date mismatch: %s %s\n", item.Title, t.Format(dateFormat))
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "published " + t.Format(dateFormat)})
+			continue
+		}
+
+		result.Matched++
+
+		if config.JSON {
+			f.matched = append(f.matched, item)
+			deferred = true
+			continue
+		}
+
+		if fetchedAt, ok := f.state.Items[key]; ok {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, already fetched %s: %s\n", fetchedAt.Format(time.RFC3339), item.Title)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "already fetched " + fetchedAt.Format(time.RFC3339)})
+			continue
+		}
+
+		if f.index != nil {
+			entry, err := f.index.lookup(key)
+			if err != nil {
+				fmt.Fprintf(f.out, "Error reading database: %s %s\n", item.Title, err)
+				result.Errors++
+				f.addReport(item, ReportEntry{Status: reportError, Error: err.Error()})
+				continue
+			}
+
+			if entry != nil {
+				if config.Verbose {
+					fmt.Fprintf(f.out, "Skipping, already in database as %s: %s\n", entry.Path, item.Title)
+				}
+				result.Skipped++
+				f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "already in database as " + entry.Path})
+				continue
+			}
+		}
+
+		if config.DryRun.enabled() {
+			fmt.Fprintf(f.out, "Skipping download, dry run enabled %s\n%s\n", item.Title, f.itemURL(item))
+			if config.DryRun == dryRunHead {
+				f.headItem(ctx, item, result)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "dry run"})
+			deferred = true
+			continue
+		}
+
+		if config.Limit > 0 && f.fetched >= config.Limit {
+			if config.Verbose {
+				fmt.Fprintf(f.out, "Skipping, limit of %d reached: %s\n", config.Limit, item.Title)
+			}
+			result.Skipped++
+			f.addReport(item, ReportEntry{Status: reportSkipped, Reason: "-limit reached"})
+			deferred = true
+			continue
+		}
+
+		f.downloadItem(ctx, item, key, t, result)
+	}
+
+	// Remember the validators only once every matched item has been handled, so a 304 on
+	// the next run can't hide items that were never downloaded.
+	if !deferred && result.Errors == unparsed && ctx.Err() == nil {
+		f.state.Feeds[feedURL] = FeedCache{
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			Date:         config.TargetDate,
+		}
+	}
+
+	return result
+}
+
+// progressReader wraps a download body and reports how much has been read to stderr.
+// When the server doesn't send a Content-Length the byte count is shown instead.
+type progressReader struct {
+	r     io.Reader
+	name  string
+	total int64
+	read  int64
+	last  int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if p.total > 0 {
+		// Only redraw when the percentage changes.
+		if pct := p.read * 100 / p.total; pct != p.last {
+			p.last = pct
+			fmt.Fprintf(os.Stderr, "\r%s: %d%%", p.name, pct)
+		}
+	} else if p.read-p.last >= 1<<20 {
+		p.last = p.read
+		fmt.Fprintf(os.Stderr, "\r%s: %d bytes", p.name, p.read)
+	}
+
+	return n, err
+}
+
+// readFeedBody reads a feed response, decompressing it when it was sent with
+// Content-Encoding: gzip or is itself a gzip file such as "feed.xml.gz".
+func readFeedBody(res *http.Response) ([]byte, error) {
+	var body io.Reader = res.Body
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// A .gz feed is usually served without Content-Encoding, so check for the gzip magic number.
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return io.ReadAll(gz)
+	}
+
+	return data, nil
+}
+
+// parseFeed decodes an RSS or JSON Feed document into items. JSON Feeds are recognised by
+// their Content-Type or a ".json" URL, everything else is treated as RSS.
+func parseFeed(feedURL string, contentType string, body []byte) ([]*Item, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	u, _ := url.Parse(feedURL)
+
+	if mediaType == "application/feed+json" || (u != nil && strings.HasSuffix(strings.TrimSuffix(u.Path, ".gz"), ".json")) {
+		var feed JSONFeed
+		if err := json.Unmarshal(body, &feed); err != nil {
+			return nil, fmt.Errorf("error decoding JSON feed: %v", err)
+		}
+
+		items := make([]*Item, 0, len(feed.Items))
+		for _, jsonItem := range feed.Items {
+			item := &Item{
+				Title:       jsonItem.Title,
+				Guid:        jsonItem.ID,
+				PublishDate: jsonItem.DatePublished,
+				Link:        jsonItem.URL,
+			}
+			if item.Link == "" {
+				item.Link = jsonItem.ExternalURL
+			}
+
+			// Attachments play the same role as RSS enclosures.
+			if len(jsonItem.Attachments) > 0 {
+				attachment := jsonItem.Attachments[0]
+				item.Enclosure = &Enclosure{URL: attachment.URL, Type: attachment.MimeType, Length: attachment.SizeInBytes}
+			}
+
+			items = append(items, item)
+		}
+
+		return items, nil
+	}
+
+	var r Response
+	if err := xml.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("error decoding RSS feed: %v", err)
+	}
+
+	return r.Ch.Items, nil
+}
+
+// resolveLinks makes each item's link and enclosure URL absolute relative to base.
+func resolveLinks(base *url.URL, items []*Item) {
+	for _, item := range items {
+		item.Link = resolveURL(base, item.Link)
+		if item.Enclosure != nil {
+			item.Enclosure.URL = resolveURL(base, item.Enclosure.URL)
+		}
+	}
+}
+
+// resolveURL resolves ref against base, returning ref unchanged if it can't be parsed.
+func resolveURL(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ref
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+
+	return base.ResolveReference(u).String()
+}
+
+// itemURL returns the URL to download for an item, its enclosure when preferred and present.
+func (f *fetcher) itemURL(item *Item) string {
+	if f.config.PreferEnclosure && item.Enclosure != nil && item.Enclosure.URL != "" {
+		return item.Enclosure.URL
+	}
+
+	return item.Link
+}
+
+// headItem sends a HEAD request for an item and reports its size and type, for -dry-run=head.
+func (f *fetcher) headItem(ctx context.Context, item *Item, result *feedResult) {
+	req, err := f.newRequest(ctx, http.MethodHead, f.itemURL(item))
+	if err != nil {
+		fmt.Fprintf(f.out, "Error creating request: %s err: %s\n", item.Title, err)
+		result.Errors++
+		return
+	}
+
+	res, err := f.do(ctx, f.itemClient, req)
+	if err != nil {
+		fmt.Fprintf(f.out, "Error fetching: %s err: %s\n", item.Title, err)
+		result.Errors++
+		return
+	}
+	res.Body.Close()
+
+	if isRedirect(res.StatusCode) {
+		loc, _ := res.Location()
+		fmt.Fprintf(f.out, "  Redirect: %s\n", loc)
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(f.out, "  Status: %s\n", res.Status)
+		return
+	}
+
+	size := "unknown"
+	if res.ContentLength >= 0 {
+		size = fmt.Sprintf("%d bytes", res.ContentLength)
+		result.HeadBytes += res.ContentLength
+	}
+
+	fmt.Fprintf(f.out, "  Size: %s Type: %s\n", size, res.Header.Get("Content-Type"))
+}
+
+// do sends req, retrying up to -retries times when the failure is one that might succeed
+// later. Other 4xx responses are returned straight away as they won't change.
+func (f *fetcher) do(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := client.Do(req.Clone(ctx))
+
+		if attempt >= f.config.Retries || ctx.Err() != nil || !retryable(res, err) {
+			return res, err
+		}
+
+		wait := retryBackoff << attempt
+		if res != nil {
+			if after, ok := retryAfter(res); ok {
+				wait = after
+			}
+			res.Body.Close()
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = res.Status
+		}
+		fmt.Fprintf(f.out, "Retrying %s in %s after %s\n", req.URL.Redacted(), wait, reason)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryable reports whether a request is worth retrying: connection errors, timeouts,
+// rate limiting, and server errors.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		// Look inside the *url.Error the client wraps everything in, it is itself a net.Error.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// retryAfter parses the Retry-After header sent with 429 and 503 responses, given either
+// as a number of seconds or an HTTP date.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		wait = time.Until(t)
+	} else {
+		return 0, false
+	}
+
+	return min(max(wait, 0), maxRetryAfter), true
+}
+
+// newRequest creates a request carrying the configured headers and basic auth.
+func (f *fetcher) newRequest(ctx context.Context, method string, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range f.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	// An explicit -header "User-Agent: ..." takes precedence.
+	if f.config.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", f.config.UserAgent)
+	}
+
+	if f.config.BasicAuth != "" {
+		user, pass, _ := strings.Cut(f.config.BasicAuth, ":")
+		req.SetBasicAuth(user, pass)
+	}
+
+	return req, nil
+}
+
+// downloadItem fetches a single item, writing either its body or the captured redirect to disk.
+func (f *fetcher) downloadItem(ctx context.Context, item *Item, key string, published time.Time, result *feedResult) {
+	config := f.config
+
+	fmt.Fprintf(f.out, "Doing %s\n", item.Title)
+
+	dir, err := f.itemDir(published)
+	if err != nil {
+		fmt.Fprintf(f.out, "Error creating directory: %s err: %s\n", item.Title, err)
+		result.Errors++
+		f.addReport(item, ReportEntry{Status: reportError, Error: err.Error()})
+		return
+	}
+
+	// Downloads are written to a .part file first, one left by an interrupted run is resumed.
+	partPath := outputPath(dir, item.Title, "part")
+
+	itemRes, offset, err := f.getItem(ctx, item, partPath)
+	if err != nil {
+		fmt.Fprintf(f.out, "Error fetching: %s err: %s\n", item.Title, err)
+		result.Errors++
+		f.addReport(item, ReportEntry{Status: reportError, Error: err.Error()})
+		return
+	}
+	defer itemRes.Body.Close()
+
+	// Where the item was finally fetched from, after any redirects were followed.
+	resolved := itemRes.Request.URL.String()
+
+	// Ordinary redirects are followed by the client, so any left are to a captured scheme.
+	// Handle them by saving the URL to a file.
+	if isRedirect(itemRes.StatusCode) {
+		loc, err := itemRes.Location()
+		if err != nil {
+			fmt.Fprintf(f.out, "Error reading redirect: %s err: %s\n", item.Title, err)
+			result.Errors++
+			f.addReport(item, ReportEntry{URL: resolved, Status: reportError, Error: err.Error()})
+			return
+		}
+
+		fmt.Fprintf(f.out, "Got %d. Writing %s\n", itemRes.StatusCode, loc)
+		ext, content := redirectFile(config, item.Title, loc.String())
+		filePath := outputPath(dir, item.Title, ext)
+		if err := os.WriteFile(filePath, content, os.FileMode(config.FileMode)); err != nil {
+			fmt.Fprintf(f.out, "Error writing: %s err: %s\n", item.Title, err)
+			result.Errors++
+			f.addReport(item, ReportEntry{URL: loc.String(), Filename: filePath, Status: reportError, Error: err.Error()})
+			return
+		}
+		f.recordFetched(key, filePath, "")
+		result.Redirects++
+		f.addReport(item, ReportEntry{URL: loc.String(), Filename: filePath, Status: reportRedirect, Bytes: int64(len(content))})
+		return
+	}
+
+	// Otherwise fetch the actual file
+	if itemRes.StatusCode == http.StatusOK || itemRes.StatusCode == http.StatusPartialContent {
+		if offset > 0 {
+			fmt.Fprintf(f.out, "Resuming %s from %d bytes\n", item.Title, offset)
+		} else {
+			fmt.Fprintf(f.out, "Writing %s\n", item.Title)
+		}
+
+		var body io.Reader = itemRes.Body
+
+		ext := config.FileExtension
+		if ext == autoExtension {
+			// Peek at the start of the body so it can be sniffed without losing any bytes.
+			// A resumed body starts mid-file, so only the Content-Type can be used.
+			var head []byte
+			buffered := bufio.NewReader(itemRes.Body)
+			if offset == 0 {
+				head, _ = buffered.Peek(512)
+			}
+			ext = detectExtension(itemRes.Header.Get("Content-Type"), head)
+			body = buffered
+		}
+
+		if config.Progress {
+			total := int64(-1)
+			if itemRes.ContentLength >= 0 {
+				total = offset + itemRes.ContentLength
+			}
+			body = &progressReader{r: body, name: item.Title, total: total, read: offset}
+		}
+
+		// Keep what we got on failure if the server will let us carry on from there next time.
+		resumable := itemRes.StatusCode == http.StatusPartialContent || itemRes.Header.Get("Accept-Ranges") == "bytes"
+
+		filePath := outputPath(dir, item.Title, ext)
+		sum, err := downloadFile(body, partPath, filePath, offset, os.FileMode(config.FileMode), resumable)
+		if config.Progress {
+			// End the progress line.
+			fmt.Fprintln(os.Stderr)
+		}
+		if err != nil {
+			fmt.Fprintf(f.out, "Error writing: %s err: %s\n", item.Title, err)
+			result.Errors++
+			f.addReport(item, ReportEntry{URL: resolved, Filename: filePath, Status: reportError, Error: err.Error()})
+			return
+		}
+
+		// The same content under another GUID is a duplicate, keep the copy we already have.
+		if f.index != nil {
+			if other, err := f.index.lookupHash(sum); err != nil {
+				fmt.Fprintf(f.out, "Error reading database: %s %s\n", item.Title, err)
+			} else if other != nil && other.Path != filePath {
+				fmt.Fprintf(f.out, "Removing %s, same content as %s\n", filePath, other.Path)
+				os.Remove(filePath)
+				f.recordFetched(key, other.Path, sum)
+				result.Skipped++
+				f.addReport(item, ReportEntry{URL: resolved, Filename: other.Path, Status: reportSkipped, Reason: "same content as " + other.Path})
+				return
+			}
+		}
+
+		f.checksums[filePath] = sum
+		f.recordFetched(key, filePath, sum)
+		result.Downloaded++
+
+		var size int64
+		if info, err := os.Stat(filePath); err == nil {
+			size = info.Size()
+		}
+		f.addReport(item, ReportEntry{URL: resolved, Filename: filePath, Status: reportDownloaded, Bytes: size})
+	} else {
+		fmt.Fprintf(f.out, "Error fetching: %s status: %s\n", item.Title, itemRes.Status)
+		result.Errors++
+		f.addReport(item, ReportEntry{URL: resolved, Status: reportError, Error: itemRes.Status})
+		return
+	}
+
+	fmt.Fprintf(f.out, "Done %s\n", item.Title)
+}
+
+// redirectFile returns the extension and content of the file saved for a captured redirect,
+// either the bare target URL or a shortcut that opens it from a file manager.
+func redirectFile(config *Config, title string, target string) (string, []byte) {
+	switch config.RedirectFormat {
+	case redirectFormatURL:
+		return "url", []byte(fmt.Sprintf("[InternetShortcut]\r\nURL=%s\r\n", target))
+	case redirectFormatDesktop:
+		return "desktop", []byte(fmt.Sprintf("[Desktop Entry]\nType=Link\nName=%s\nURL=%s\n", strings.Join(strings.Fields(title), " "), target))
+	}
+
+	return config.RedirectFileExtension, []byte(target)
+}
+
+// isRedirect reports whether a status code is one the client follows.
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
+
+// itemDir returns the directory an item is written to, creating the per-date subdirectory
+// when -date-subdir is set.
+func (f *fetcher) itemDir(published time.Time) (string, error) {
+	if !f.config.DateSubdir {
+		return f.config.OutputDir, nil
+	}
+
+	dir := path.Join(f.config.OutputDir, published.Format(dateFormat))
+	return dir, os.MkdirAll(dir, os.FileMode(f.config.DirMode))
+}
+
+// addReport records an item's outcome for the -report, filling in the item's details and
+// the URL it would be fetched from unless the entry already has one.
+func (f *fetcher) addReport(item *Item, entry ReportEntry) {
+	if f.config.Report == "" {
+		return
+	}
+
+	entry.Title = item.Title
+	entry.Guid = item.Guid
+	if entry.URL == "" {
+		entry.URL = f.itemURL(item)
+	}
+	f.report = append(f.report, entry)
+}
+
+// recordFetched marks an item as fetched in the state, database, and towards the -limit.
+func (f *fetcher) recordFetched(key string, filePath string, sum string) {
+	now := time.Now()
+	f.state.Items[key] = now
+	f.fetched++
+
+	if f.index != nil {
+		if err := f.index.record(key, indexEntry{Path: filePath, SHA256: sum, FetchedAt: now}); err != nil {
+			fmt.Fprintf(f.out, "Error writing database: %s %s\n", key, err)
+		}
+	}
+}
+
+// getItem requests an item, asking for just the rest of it when partPath holds the start
+// of an earlier attempt. It returns the response and the offset the body starts at.
+func (f *fetcher) getItem(ctx context.Context, item *Item, partPath string) (*http.Response, int64, error) {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := f.newRequest(ctx, http.MethodGet, f.itemURL(item))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating request: %v", err)
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	res, err := f.do(ctx, f.itemClient, req)
+	if err != nil || offset == 0 {
+		return res, 0, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent && strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		return res, offset, nil
+
+	case res.StatusCode == http.StatusOK || isRedirect(res.StatusCode):
+		// The server ignored the range, so this is the whole file.
+		return res, 0, nil
+	}
+
+	// The part is unusable, e.g. 416 because it's bigger than the file now is, so start over.
+	res.Body.Close()
+	os.Remove(partPath)
+	req.Header.Del("Range")
+
+	res, err = f.do(ctx, f.itemClient, req)
+	return res, 0, err
+}
+
+// downloadFile streams body into partPath, appending to what's already there when offset is
+// set, then moves the complete file to filePath. It returns the hex SHA-256 of the whole file.
+// On failure the part is removed unless it can be resumed later.
+func downloadFile(body io.Reader, partPath string, filePath string, offset int64, perm os.FileMode, resumable bool) (string, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR
+	}
+
+	file, err := os.OpenFile(partPath, flags, perm)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if offset > 0 {
+		// Hash what was written before, which also leaves the file positioned at the end of it.
+		_, err = io.CopyN(hash, file, offset)
+	}
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(file, hash), body)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		if !resumable {
+			os.Remove(partPath)
+		}
+		return "", err
+	}
+
+	if err := os.Rename(partPath, filePath); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeReport writes the item outcomes to reportPath as a JSON array, through a temporary
+// file so a crash part way can't leave a truncated report.
+func writeReport(reportPath string, entries []ReportEntry, perm os.FileMode) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := reportPath + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, reportPath)
+}
+
+// writeManifest merges checksums into the SHA256SUMS style manifest at manifestPath, so it
+// can be checked with "sha256sum -c". Paths are written relative to the manifest's directory.
+func writeManifest(manifestPath string, checksums map[string]string, perm os.FileMode) error {
+	dir, err := filepath.Abs(filepath.Dir(manifestPath))
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]string{}
+
+	// Keep entries from previous runs, anything downloaded again is replaced below.
+	if existing, err := os.ReadFile(manifestPath); err == nil {
+		for _, line := range strings.Split(string(existing), "\n") {
+			sum, name, ok := strings.Cut(line, "  ")
+			if ok {
+				entries[name] = sum
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for filePath, sum := range checksums {
+		name := filePath
+		if abs, err := filepath.Abs(filePath); err == nil {
+			if rel, err := filepath.Rel(dir, abs); err == nil {
+				name = rel
+			}
+		}
+		entries[name] = sum
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", entries[name], name)
+	}
+
+	return os.WriteFile(manifestPath, []byte(b.String()), perm)
+}
+
+// detectExtension returns the file extension for a response, preferring its Content-Type
+// header and falling back to sniffing the first bytes of the body.
+func detectExtension(contentType string, head []byte) string {
+	candidates := []string{contentType}
+	if len(head) > 0 {
+		candidates = append(candidates, http.DetectContentType(head))
+	}
+
+	for _, ct := range candidates {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || mediaType == "application/octet-stream" {
+			continue
+		}
+
+		if ext, ok := preferredExtensions[mediaType]; ok {
+			return ext
+		}
+
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			return strings.TrimPrefix(exts[0], ".")
+		}
+	}
+
+	return fallbackExtension
+}
+
+// parsePublishDate parses a pubDate using the first of publishDateLayouts that matches.
+func parsePublishDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range publishDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognised date format %q", value)
+}
+
+// outputPath builds the path to write an item to in dir, using its sanitized title as the filename.
+func outputPath(dir string, title string, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%s.%s", sanitizeFilename(title), ext))
+}
+
+// sanitizeFilename replaces characters that are illegal in filenames on common
+// filesystems and collapses runs of whitespace, so a title is always a single path element.
+func sanitizeFilename(title string) string {
+	var b strings.Builder
+	for _, r := range title {
+		switch {
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			b.WriteRune('-')
+		case unicode.IsControl(r) || unicode.IsSpace(r):
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// Collapse whitespace and drop leading/trailing dots so we never produce ".." or hidden files.
+	name := strings.Join(strings.Fields(b.String()), " ")
+	name = strings.Trim(name, ". ")
+	if name == "" {
+		return "untitled"
+	}
+
+	return name
+}
+
+// parseHeaders parses 'Key: Value' strings into a header set.
+func parseHeaders(values []string) (http.Header, error) {
+	header := http.Header{}
+	for _, value := range values {
+		key, v, ok := strings.Cut(value, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q is not in the form 'Key: Value'", value)
+		}
+		header.Add(key, strings.TrimSpace(v))
+	}
+
+	return header, nil
+}
+
+// containsAny reports whether title contains any of the keywords, ignoring case, and which one.
+func containsAny(title string, keywords []string) (string, bool) {
+	title = strings.ToLower(title)
+	for _, keyword := range keywords {
+		if strings.Contains(title, strings.ToLower(keyword)) {
+			return keyword, true
+		}
+	}
+
+	return "", false
+}
+
+// compileRegexp compiles expr, returning nil when it is empty so the filter is disabled.
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile(expr)
+}
+
+// truncate shortens s to at most n bytes for logging.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n] + "..."
+}
+
+// feedURLs returns the -url value followed by any URLs listed in the -urls-file.
+// Blank lines and lines starting with '#' are ignored.
+func feedURLs(config *Config) ([]string, error) {
+	var urls []string
+	if config.URL != "" {
+		urls = append(urls, config.URL)
+	}
+
+	if config.URLsFile == "" {
+		return urls, nil
+	}
+
+	file, err := os.Open(config.URLsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+
+	return urls, scanner.Err()
+}
+
+// readConfig decodes the JSON configuration file over the flag defaults, then
+// re-applies any flags given explicitly on the command line so they take precedence.
+func readConfig(flags *flag.FlagSet, filePath string, config *Config) error {
+	// Repeatable flags collect into their own lists, which main merges with the config file's,
+	// so setting them again here would only add each value twice.
+	explicit := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		if _, ok := f.Value.(*stringList); ok {
+			return
+		}
+		explicit[f.Name] = f.Value.String()
+	})
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening configuration file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("error decoding configuration JSON: %v", err)
+	}
+
+	for name, value := range explicit {
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("error applying flag %s: %v", name, err)
+		}
 	}
 
-	fmt.Println("Done all!")
+	return nil
 }
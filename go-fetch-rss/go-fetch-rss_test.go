@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadConfigRepeatableFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"url": "http://example.com/feed", "outputDir": "from-file"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{}
+	var headers stringList
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&headers, "header", "")
+	flags.StringVar(&config.OutputDir, "out", ".", "")
+	if err := flags.Parse([]string{"-header", "X-Key: k1", "-header", "X-Other: k2", "-out", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := readConfig(flags, path, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (stringList{"X-Key: k1", "X-Other: k2"}); !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %q, want %q", headers, want)
+	}
+	if config.OutputDir != "from-flag" {
+		t.Errorf("OutputDir = %q, want the flag to override the file", config.OutputDir)
+	}
+	if config.URL != "http://example.com/feed" {
+		t.Errorf("URL = %q, want the value from the file", config.URL)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Plain Title", "Plain Title"},
+		{"Ep: One/1", "Ep- One-1"},
+		{`back\slash*star?"quote"<lt>|pipe`, "back-slash-star--quote--lt--pipe"},
+		{"12:30 News", "12-30 News"},
+		{"🎉 Party 🎉", "🎉 Party 🎉"},
+		{"Café/Crème", "Café-Crème"},
+		{"  spaced\tout\nnewline  ", "spaced out newline"},
+		{"..hidden..", "hidden"},
+		{"../../etc/passwd", "-..-etc-passwd"},
+		{"", "untitled"},
+		{" ... ", "untitled"},
+	}
+
+	for _, test := range tests {
+		if got := sanitizeFilename(test.title); got != test.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
+
+func TestParsePublishDate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"Thu, 11 Jan 2024 21:00:00 -0500", time.Date(2024, 1, 12, 2, 0, 0, 0, time.UTC)},
+		{"Thu, 11 Jan 2024 21:00:00 GMT", time.Date(2024, 1, 11, 21, 0, 0, 0, time.UTC)},
+		{"Thu, 11 Jan 2024 21:00:00 +0000", time.Date(2024, 1, 11, 21, 0, 0, 0, time.UTC)},
+		{"  Thu, 11 Jan 2024 21:00:00 +0100\n", time.Date(2024, 1, 11, 20, 0, 0, 0, time.UTC)},
+		{"2024-01-11T21:00:00Z", time.Date(2024, 1, 11, 21, 0, 0, 0, time.UTC)},
+		{"2024-01-11T21:00:00+02:00", time.Date(2024, 1, 11, 19, 0, 0, 0, time.UTC)},
+		{"2024-01-11 21:00:00", time.Date(2024, 1, 11, 21, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		got, err := parsePublishDate(test.value)
+		if err != nil {
+			t.Errorf("parsePublishDate(%q) error: %v", test.value, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("parsePublishDate(%q) = %s, want %s", test.value, got.UTC(), test.want)
+		}
+	}
+
+	if _, err := parsePublishDate("sometime last week"); err == nil {
+		t.Error("parsePublishDate of an unparseable date returned no error")
+	}
+}
+
+const sampleJSONFeed = `{
+  "version": "https://jsonfeed.org/version/1.1",
+  "title": "Sample",
+  "items": [
+    {"id": "1", "title": "With URL", "url": "https://example.com/1", "external_url": "https://elsewhere.com/1", "date_published": "2024-01-11T21:00:00Z"},
+    {"id": "2", "title": "External only", "external_url": "https://elsewhere.com/2", "date_published": "2024-01-11T22:00:00Z"},
+    {"id": "3", "title": "Podcast", "url": "https://example.com/3", "date_published": "2024-01-11T23:00:00Z",
+     "attachments": [{"url": "https://cdn.example.com/3.mp3", "mime_type": "audio/mpeg", "size_in_bytes": 1234}, {"url": "https://cdn.example.com/3.ogg"}]}
+  ]
+}`
+
+func TestParseFeedJSON(t *testing.T) {
+	items, err := parseFeed("https://example.com/feed", "application/feed+json; charset=utf-8", []byte(sampleJSONFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+
+	if items[0].Guid != "1" || items[0].Title != "With URL" || items[0].PublishDate != "2024-01-11T21:00:00Z" {
+		t.Errorf("item 0 = %+v, want its id, title and date_published mapped", items[0])
+	}
+	if items[0].Link != "https://example.com/1" {
+		t.Errorf("item 0 link = %q, want url preferred over external_url", items[0].Link)
+	}
+	if items[1].Link != "https://elsewhere.com/2" {
+		t.Errorf("item 1 link = %q, want the external_url fallback", items[1].Link)
+	}
+	if items[1].Enclosure != nil {
+		t.Errorf("item 1 enclosure = %+v, want none without attachments", items[1].Enclosure)
+	}
+
+	want := Enclosure{URL: "https://cdn.example.com/3.mp3", Type: "audio/mpeg", Length: 1234}
+	if items[2].Enclosure == nil || *items[2].Enclosure != want {
+		t.Errorf("item 2 enclosure = %+v, want the first attachment %+v", items[2].Enclosure, want)
+	}
+}
+
+func TestParseFeedJSONDetection(t *testing.T) {
+	tests := []struct {
+		feedURL     string
+		contentType string
+	}{
+		{"https://example.com/feed", "application/feed+json"},
+		{"https://example.com/feed.json", "text/plain"},
+		{"https://example.com/feed.json?key=abc", ""},
+		{"https://example.com/feed.json.gz", "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		items, err := parseFeed(test.feedURL, test.contentType, []byte(sampleJSONFeed))
+		if err != nil || len(items) != 3 {
+			t.Errorf("parseFeed(%q, %q) = %d items, %v, want it read as a JSON Feed", test.feedURL, test.contentType, len(items), err)
+		}
+	}
+
+	// Anything else is RSS, which a JSON document isn't.
+	if _, err := parseFeed("https://example.com/feed.xml", "application/rss+xml", []byte(sampleJSONFeed)); err == nil {
+		t.Error("parseFeed of JSON as RSS returned no error")
+	}
+}
+
+func TestResolveLinks(t *testing.T) {
+	base, err := url.Parse("https://example.com/podcasts/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"episodes/1.mp3", "https://example.com/podcasts/episodes/1.mp3"},
+		{"/files/2.mp3", "https://example.com/files/2.mp3"},
+		{"../3.mp3", "https://example.com/3.mp3"},
+		{"?id=4", "https://example.com/podcasts/feed.xml?id=4"},
+		{"//cdn.example.net/5.mp3", "https://cdn.example.net/5.mp3"},
+		{"http://other.example.org/6.mp3", "http://other.example.org/6.mp3"},
+		{"magnet:?xt=urn:btih:abc", "magnet:?xt=urn:btih:abc"},
+		{"  spaced.mp3  ", "https://example.com/podcasts/spaced.mp3"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		items := []*Item{{Link: test.link, Enclosure: &Enclosure{URL: test.link}}}
+		resolveLinks(base, items)
+		if items[0].Link != test.want {
+			t.Errorf("link %q resolved to %q, want %q", test.link, items[0].Link, test.want)
+		}
+		if items[0].Enclosure.URL != test.want {
+			t.Errorf("enclosure %q resolved to %q, want %q", test.link, items[0].Enclosure.URL, test.want)
+		}
+	}
+
+	// Items without an enclosure are left without one.
+	items := []*Item{{Link: "a.mp3"}}
+	resolveLinks(base, items)
+	if items[0].Enclosure != nil {
+		t.Errorf("enclosure = %+v, want nil", items[0].Enclosure)
+	}
+}
+
+const sampleRSS = `<rss><channel><title>T</title><item><title>One</title><guid>g1</guid><link>https://example.com/1</link></item></channel></rss>`
+
+// gzipped returns data compressed as a gzip fixture.
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadFeedBody(t *testing.T) {
+	fixture := gzipped(t, sampleRSS)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/encoded", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write(fixture)
+	})
+	mux.HandleFunc("/feed.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(fixture)
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sampleRSS))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, path := range []string{"/encoded", "/feed.xml.gz", "/plain"} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// As processFeed does, which turns off the transport's own decompression.
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := readFeedBody(res)
+		res.Body.Close()
+		if err != nil {
+			t.Errorf("%s: readFeedBody error: %v", path, err)
+			continue
+		}
+		if string(body) != sampleRSS {
+			t.Errorf("%s: readFeedBody = %q, want the decompressed feed", path, body)
+		}
+
+		items, err := parseFeed(server.URL+path, res.Header.Get("Content-Type"), body)
+		if err != nil || len(items) != 1 || items[0].Title != "One" {
+			t.Errorf("%s: parseFeed = %v, %v, want the one item", path, items, err)
+		}
+	}
+}
+
+func TestProcessFeedValidators(t *testing.T) {
+	// One item from another day and one whose date can't be parsed, so nothing is downloaded.
+	const feed = `<rss><channel><title>T</title>` +
+		`<item><title>Old</title><guid>g1</guid><link>https://example.com/1</link><pubDate>Mon, 01 Jan 2024 09:00:00 +0000</pubDate></item>` +
+		`<item><title>Bad</title><guid>g2</guid><link>https://example.com/2</link><pubDate>sometime</pubDate></item>` +
+		`</channel></rss>`
+
+	var ifNoneMatch string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		if ifNoneMatch == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(feed))
+	}))
+	defer server.Close()
+
+	config := &Config{State: "state.json", TargetDate: "2024-01-02"}
+	f := &fetcher{
+		config:     config,
+		out:        io.Discard,
+		location:   time.UTC,
+		state:      &State{Items: map[string]time.Time{}, Feeds: map[string]FeedCache{}},
+		feedClient: server.Client(),
+	}
+
+	// An unparseable date isn't a download error, so the validators are still stored.
+	result := f.processFeed(context.Background(), server.URL)
+	if result.Err != nil || result.Errors != 1 {
+		t.Fatalf("processFeed = %v with %d errors, want 1 parse error", result.Err, result.Errors)
+	}
+	if got, want := f.state.Feeds[server.URL], (FeedCache{ETag: `"v1"`, Date: "2024-01-02"}); got != want {
+		t.Fatalf("stored %+v, want %+v", got, want)
+	}
+
+	f.processFeed(context.Background(), server.URL)
+	if ifNoneMatch != `"v1"` {
+		t.Errorf("same date sent If-None-Match %q, want the stored ETag", ifNoneMatch)
+	}
+
+	// A run for another date has to see the whole feed again.
+	config.TargetDate = "2024-01-01"
+	f.processFeed(context.Background(), server.URL)
+	if ifNoneMatch != "" {
+		t.Errorf("different date sent If-None-Match %q, want none", ifNoneMatch)
+	}
+}
+
+func TestIndexLookupHash(t *testing.T) {
+	idx, err := openIndex(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idx.record("g1", indexEntry{Path: "one.mp3", SHA256: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := idx.lookupHash("abc")
+	if err != nil || entry == nil || entry.Path != "one.mp3" {
+		t.Fatalf("lookupHash = %+v, %v, want the entry for one.mp3", entry, err)
+	}
+
+	// A database error mustn't look like there's no duplicate.
+	idx.Close()
+	if entry, err := idx.lookupHash("abc"); err == nil {
+		t.Errorf("lookupHash on a closed database = %+v, want an error", entry)
+	}
+}
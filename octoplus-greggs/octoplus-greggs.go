@@ -1,49 +1,424 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"image"
+	"image/draw"
+	"image/png"
 	"io"
 	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/aztec"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/code39"
+	"github.com/boombuler/barcode/code93"
+	"github.com/boombuler/barcode/datamatrix"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/pdf417"
+	"github.com/jung-kurt/gofpdf"
 	"github.com/mailgun/mailgun-go"
 	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	configFile      = flag.String("config", "config.json", "Path to the configuration file")
-	octopusAPIKey   string
-	octopusAPIToken string
-	mailgunDomain   string
-	mailgunApiKey   string
-	mailgunFrom     string
-	mailgunTo       string
+	verbose           = flag.Bool("verbose", false, "Log debug detail, including each HTTP request")
+	quiet             = flag.Bool("quiet", false, "Only log warnings and errors")
+	configFile        = flag.String("config", "config.json", "Path to the configuration file, or - to read it from stdin")
+	tokenCacheFile    = flag.String("token-cache", "token-cache.json", "Path to the file caching the Octopus API token between runs")
+	noTokenCache      = flag.Bool("no-token-cache", false, "Ignore the cached Octopus API token and authenticate again")
+	attempts          = flag.Int("attempts", 3, "Number of attempts for each Octopus API, webhook or Mailgun request before giving up")
+	retryBackoff      = flag.Duration("retry-backoff", time.Second, "Delay before the first retry of an Octopus API, webhook or Mailgun request, doubled on each retry")
+	interval          = flag.Duration("interval", 0, "Keep running and check for new rewards this often, e.g. 1h (default check once)")
+	once              = flag.Bool("once", false, "Check once and exit, even if -interval is set")
+	authQueryFile     = flag.String("auth-query", "", "Path to a JSON GraphQL request body replacing the built-in token query")
+	rewardQueryFile   = flag.String("reward-query", "", "Path to a JSON GraphQL request body replacing the built-in rewards query")
+	authScheme        = flag.String("auth-scheme", "", "Scheme to prefix the Octopus API token with in the Authorization header, e.g. Bearer or JWT (default the bare token)")
+	proxy             = flag.String("proxy", "", "Proxy URL for the Octopus, Mailgun and other API calls, e.g. http://proxy:3128 (default from HTTPS_PROXY)")
+	timeout           = flag.Duration("timeout", time.Minute, "Overall time limit for the Octopus API requests, including retries")
+	rewardIDList      = flag.String("reward-id", "", "Fetch only the rewards with these comma-separated IDs, each in its own request, and send them all together whatever -rewards says")
+	jobs              = flag.Int("jobs", 4, "Number of -reward-id rewards to fetch at once")
+	rewardsMode       = flag.String("rewards", "first", "Which rewards to send: first (as returned by the API), latest (highest ID), or all")
+	statusFilter      = flag.String("status", "", "Comma-separated reward statuses to notify about, e.g. AVAILABLE,READY (default all)")
+	claimableOnly     = flag.Bool("claimable-only", false, "Only notify about rewards whose status is in -claimable, i.e. ready to spend")
+	claimable         = flag.String("claimable", "AVAILABLE,CLAIMED", "Comma-separated reward statuses that -claimable-only treats as ready to spend")
+	archiveDir        = flag.String("archive-dir", "", "Directory to save each run's raw rewards response to as timestamped JSON")
+	stateFile         = flag.String("state", "", "Path to a JSON file recording vouchers already notified about, so they're only sent once")
+	qrDir             = flag.String("qr-dir", "", "Directory to save each voucher's barcode image to as <code>.png, or .svg with -qr-format=svg")
+	qrSize            = flag.Int("qr-size", 256, "QR code image size in pixels")
+	qrFormat          = flag.String("qr-format", "png", "Image format for QR codes and barcodes: png or svg")
+	qrSource          = flag.String("qr-source", "barcode", "Voucher field to encode in QR codes and barcodes: barcode (the barcode value) or code (the voucher code)")
+	qrEC              = flag.String("qr-ec", "medium", "QR code error correction level: low, medium, high, or highest")
+	jsonOutput        = flag.Bool("json", false, "Print the selected rewards and their vouchers to stdout as JSON instead of sending notifications")
+	noEmail           = flag.Bool("no-email", false, "Don't send a notification, e.g. to only save barcodes with -qr-dir")
+	notifyChannel     = flag.String("notify", "email", "Comma-separated channels to send notifications to: email (Mailgun), smtp, slack, telegram, pushover, or webhook")
+	priority          = flag.String("priority", "normal=0,expiring=1", "Pushover priorities from -2 to 2 for normal notifications and those with vouchers expiring within -expiry-warn")
+	pushoverAttach    = flag.Bool("pushover-attach", false, "Attach the first voucher's barcode image to each Pushover notification")
+	webhookTimeout    = flag.Duration("webhook-timeout", 10*time.Second, "Time limit for each webhook request")
+	bodyTemplateFile  = flag.String("body-template", "", "Path to a Go text/template for the plain text email body (default built-in)")
+	attachmentName    = flag.String("attachment-name", "", "Go template naming each barcode attachment, e.g. '{{.PriceTag}}-{{.Code}}.{{.Format}}' (default <code>.<format>)")
+	templateFile      = flag.String("template", "", "Path to an HTML template for the email body (default built-in)")
+	notifyEmpty       = flag.Bool("notify-empty", false, "Notify about rewards with no vouchers yet, labelled as such, instead of skipping them")
+	notifyFailures    = flag.Bool("notify-failures", false, "Email the error via Mailgun when a run fails")
+	dryRun            = flag.Bool("dry-run", false, "Fetch and render everything, but log the notification instead of sending it")
+	octopusKeyFlag    = flag.String("octopus-key", "", "Octopus API key, overriding octopusAPIKey and OCTOPUS_API_KEY. Visible to other local users, so best kept to one-off runs")
+	mailgunDomainFlag = flag.String("mailgun-domain", "", "Mailgun sending domain, overriding mailgunDomain and MAILGUN_DOMAIN")
+	mailgunKeyFlag    = flag.String("mailgun-key", "", "Mailgun API key, overriding mailgunApiKey and MAILGUN_API_KEY. Visible to other local users, so best kept to one-off runs")
+	mailgunFromFlag   = flag.String("mailgun-from", "", "Email sender address, overriding mailgunFrom and MAILGUN_FROM")
+	mailgunToFlag     = flag.String("mailgun-to", "", "Comma-separated email recipients, overriding mailgunTo and MAILGUN_TO")
+	smtpHostFlag      = flag.String("smtp-host", "", "SMTP server, overriding smtpHost and SMTP_HOST")
+	slackWebhookFlag  = flag.String("slack-webhook", "", "Slack incoming webhook URL, overriding slackWebhookURL and SLACK_WEBHOOK_URL")
+	webhookURLFlag    = flag.String("webhook-url", "", "Webhook URL, overriding webhookURL and WEBHOOK_URL")
+	telegramChatFlag  = flag.String("telegram-chat", "", "Telegram chat ID, overriding telegramChatID and TELEGRAM_CHAT_ID")
+	pushoverUserFlag  = flag.String("pushover-user", "", "Pushover user key, overriding pushoverUserKey and PUSHOVER_USER_KEY")
+	mailgunRegionFlag = flag.String("mailgun-region", "", "Mailgun region of the sending domain: us or eu. Domains created in the EU region must use eu (default us)")
+	fromNameFlag      = flag.String("from-name", "", "Display name for the email From header, e.g. 'Octoplus Rewards'")
+	label             = flag.String("label", "", "Account label to show with the fetch time in the email subject and body")
+	timezone          = flag.String("timezone", "", "IANA timezone for voucher expiry times and the fetch time shown with -label, e.g. Europe/London (default local)")
+	expiryLayout      = flag.String("expiry-layout", "Mon 2 Jan 2006 15:04 MST", "Go time layout for voucher expiry times in the console output and notifications")
+	subjectTemplate   = flag.String("subject", "", "Email subject as a Go template evaluated against the reward, e.g. 'Octoplus reward {{.PriceTag}} ({{.Status}})'")
+	expiryWarn        = flag.Duration("expiry-warn", 0, "Mark vouchers expiring within this long, e.g. 72h, and remind about them once more")
+	pdfSummary        = flag.Bool("pdf", false, "Attach a printable PDF listing each voucher with its barcode")
+	icsReminder       = flag.Bool("ics", false, "Attach an ICS calendar reminder for each voucher's expiry")
+	icsDays           = flag.Int("ics-days", 1, "Days before voucher expiry to schedule the ICS reminder")
+	httpDebug         = flag.Bool("http-debug", false, "Log each HTTP request's method, URL and headers and each response's status and body")
+	redact            = flag.Bool("redact", true, "Mask the Octopus API token and other credentials as **** in log output. Set -redact=false only for debugging, -http-debug still masks the token")
+	healthFile        = flag.String("health-file", "", "Path to write the time of each successful run to, as a single RFC3339 timestamp, for a watchdog to check")
+	metricsFile       = flag.String("metrics-file", "", "Path to write run metrics to after each run, in the Prometheus textfile collector format")
+	metricsAddr       = flag.String("metrics-addr", "", "Address to serve run metrics on at /metrics in watch mode, e.g. :9101")
+	emailPerReward    = flag.Bool("email-per-reward", false, "Send one notification per reward instead of a single combined one")
+	mailgunDomain     string
+	mailgunApiKey     string
+	mailgunFrom       string
+	fromName          string
+	mailgunTo         []string
+	slackWebhookURL   string
+	subjectTmpl       *texttemplate.Template
+	mailgunRegion     string
+	notifyChannels    []string
+	displayLocation   = time.Local
+	bodyTemplate      *texttemplate.Template
+	emailTemplate     *template.Template
+	mailgunChecked    bool
+	nameTemplate      *texttemplate.Template
+	qrRecoveryLevel   = qrcode.Medium
+	httpClient        = http.DefaultClient
+	normalPriority    int
+	expiringPriority  int
+	metrics           = &Metrics{}
+	logRedactor       = &RedactingWriter{Out: os.Stderr}
+	rewardIDs         []int
 )
 
+// Log levels, messages below the selected level are dropped
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+)
+
+// logLevel is set from -verbose and -quiet
+var logLevel = levelInfo
+
+// octopusGraphQLURL is the Octopus Energy (Kraken) GraphQL endpoint
+const octopusGraphQLURL = "https://api.octopus.energy/v1/graphql/"
+
+// authRequest and rewardRequest are the built-in GraphQL requests, replaced by -auth-query
+// and -reward-query. The API key is always added to the auth request as the "key" variable.
+var (
+	authRequest = GraphQLRequest{
+		Query: "mutation krakenTokenAuthentication($key: String!) { obtainKrakenToken(input: {APIKey: $key}) { token payload }}",
+	}
+	rewardRequest = GraphQLRequest{
+		Query: "query getOctoplusRewards($rewardId: Int) {\noctoplusRewards(rewardId: $rewardId) {\nid\npriceTag\nstatus\nvouchers {\n ... on OctoplusVoucherType {\ncode\nbarcodeValue\nbarcodeFormat\nexpiresAt}}}}",
+	}
+)
+
+// authErrorCodes are the Kraken GraphQL error codes meaning the token was missing, invalid or expired
+var authErrorCodes = map[string]bool{
+	"KT-CT-1111": true,
+	"KT-CT-1112": true,
+	"KT-CT-1124": true,
+}
+
+// errUnauthorized is returned when the Octopus API rejects the token
+var errUnauthorized = errors.New("unauthorized")
+
+// tokenPattern matches Octopus API tokens in response bodies, masked by -http-debug
+var tokenPattern = regexp.MustCompile(`("token"\s*:\s*)"[^"]*"`)
+
+// telegramAPIURL is the Telegram Bot API base URL, followed by /bot<token>/<method>
+const telegramAPIURL = "https://api.telegram.org"
+
+// telegramMessageLimit is the most characters Telegram accepts in one message
+const telegramMessageLimit = 4096
+
+// pushoverAPIURL is the Pushover endpoint for sending messages
+const pushoverAPIURL = "https://api.pushover.net/1/messages.json"
+
+// tokenExpiryMargin is how long before expiry a cached token stops being reused
+const tokenExpiryMargin = 5 * time.Minute
+
+// maxRetryAfter caps how long a server's Retry-After can make a retry wait
+const maxRetryAfter = 5 * time.Minute
+
+// defaultEmailSubject is used when no subject template is configured
+const defaultEmailSubject = "Octopus API - New Reward Generated"
+
+// defaultBodyTemplate is the plain text email body, replaced by -body-template
+const defaultBodyTemplate = `{{if .Label}}Account: {{.Label}}
+Fetched: {{.FetchedAt}}
+
+{{end}}{{range $i, $reward := .Rewards}}{{if $i}}
+{{end}}Octopus Energy Reward
+ID: {{.ID}}
+Price Tag: {{.PriceTag}}
+Status: {{.Status}}
+
+Vouchers:
+{{range $j, $voucher := .Vouchers}}Voucher {{inc $j}}:
+  Code: {{.Code}}
+  Barcode Value: {{.BarcodeValue}}
+  Barcode Format: {{.BarcodeFormat}}
+  Expires At: {{expiry .ExpiresAt}}
+{{if expiringSoon .}}  ⚠ expiring soon
+{{end}}{{else}}  No vouchers yet
+{{end}}{{end}}`
+
+// defaultEmailTemplate lays out each voucher with its barcode inlined, see renderEmailHTML
+const defaultEmailTemplate = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif;">
+{{if .Label}}
+  <p>Account: {{.Label}}<br>Fetched: {{.FetchedAt}}</p>
+{{end}}
+{{range .Rewards}}
+  <h2>Octopus Energy Reward {{.ID}}</h2>
+  <p>Price Tag: {{.PriceTag}}<br>Status: {{.Status}}</p>
+  {{range .Vouchers}}
+  <div style="margin-bottom: 24px;">
+    <img src="{{barcodeSrc .}}" alt="{{.Code}}"><br>
+    <strong>{{.Code}}</strong><br>
+    Expires At: {{expiry .ExpiresAt}}{{if expiringSoon .}} <strong style="color: #c00;">⚠ expiring soon</strong>{{end}}
+  </div>
+  {{else}}
+  <p><em>No vouchers yet</em></p>
+  {{end}}
+{{end}}
+</body>
+</html>
+`
+
 type Config struct {
 	OctopusAPIKey string `json:"octopusAPIKey"`
 	MailgunDomain string `json:"mailgunDomain"`
 	MailgunApiKey string `json:"mailgunApiKey"`
 	MailgunFrom   string `json:"mailgunFrom"`
+	FromName      string `json:"fromName"`
 	MailgunTo     string `json:"mailgunTo"`
+	// MailgunRegion must be "eu" for domains created in Mailgun's EU region, sends to the
+	// default US API are rejected for them
+	MailgunRegion string `json:"mailgunRegion"`
+	EmailSubject  string `json:"emailSubject"`
+
+	// The SMTP notifier sends from mailgunFrom to mailgunTo. SMTPTLS is starttls (the
+	// default), tls for implicit TLS such as port 465, or none.
+	SMTPHost     string `json:"smtpHost"`
+	SMTPPort     int    `json:"smtpPort"`
+	SMTPUsername string `json:"smtpUsername"`
+	SMTPPassword string `json:"smtpPassword"`
+	SMTPTLS      string `json:"smtpTLS"`
+
+	SlackWebhookURL string `json:"slackWebhookURL"`
+
+	// TelegramChatID is the numeric chat ID, or @channelname for a public channel
+	TelegramBotToken string `json:"telegramBotToken"`
+	TelegramChatID   string `json:"telegramChatID"`
+
+	// PushoverAppToken is the application's API token, PushoverUserKey the user or group to alert
+	PushoverAppToken string `json:"pushoverAppToken"`
+	PushoverUserKey  string `json:"pushoverUserKey"`
+
+	// WebhookHeaders are added to each webhook request, e.g. for an Authorization token
+	WebhookURL     string            `json:"webhookURL"`
+	WebhookHeaders map[string]string `json:"webhookHeaders"`
+}
+
+// Notifier delivers rewards to a notification channel
+type Notifier interface {
+	Notify(rewards []OctoplusReward) error
+}
+
+// MailgunNotifier emails rewards via Mailgun
+type MailgunNotifier struct{}
+
+// SMTPNotifier emails rewards through an SMTP server
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLS      string
+}
+
+// MultiNotifier sends rewards to several channels, named in Channels alongside Notifiers
+type MultiNotifier struct {
+	Channels  []string
+	Notifiers []Notifier
+}
+
+// NotifyError reports which channels of a MultiNotifier failed and which succeeded
+type NotifyError struct {
+	Succeeded []string
+	Failed    map[string]error
+}
+
+// Email is a rendered notification email, shared by the Mailgun and SMTP notifiers
+type Email struct {
+	Subject     string
+	Text        string
+	HTML        string
+	Inline      map[string][]byte
+	Attachments map[string][]byte
+}
+
+// SlackNotifier posts rewards to a Slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+// TelegramNotifier sends rewards to a Telegram chat through the Bot API
+type TelegramNotifier struct {
+	BotToken string
+	ChatID   string
+}
+
+// PushoverNotifier sends rewards as Pushover push notifications
+type PushoverNotifier struct {
+	AppToken string
+	UserKey  string
+}
+
+// WebhookNotifier posts rewards as JSON to a custom endpoint
+type WebhookNotifier struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+// DebugTransport logs each HTTP exchange for -http-debug. Any Authorization header or token
+// in the output is always masked, -redact=false doesn't change that.
+type DebugTransport struct {
+	Next http.RoundTripper
+}
+
+// RedactingWriter is the log output with -redact, replacing known secret values with ****
+// before they're written
+type RedactingWriter struct {
+	mu      sync.Mutex
+	Out     io.Writer
+	secrets []string
+}
+
+// Metrics records the outcome of the latest run for -metrics-file and -metrics-addr
+type Metrics struct {
+	mu           sync.Mutex
+	LastRun      time.Time
+	LastSuccess  time.Time
+	Success      bool
+	RewardsFound int
+	VouchersSent int
+}
+
+// OctopusClient talks to the Octopus Energy GraphQL API and holds the current token
+type OctopusClient struct {
+	HTTPClient  *http.Client
+	BaseURL     string
+	APIKey      string
+	Token       string
+	TokenExpiry time.Time
+}
+
+type GraphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type GraphQLError struct {
+	Message    string `json:"message"`
+	Extensions struct {
+		ErrorCode string `json:"errorCode"`
+	} `json:"extensions"`
 }
 
 type TokenResponse struct {
 	Data struct {
-		ObtainKrakenToken map[string]interface{} `json:"obtainKrakenToken"`
+		ObtainKrakenToken struct {
+			Token string `json:"token"`
+			// Payload holds the token's claims, Exp is its expiry as a unix timestamp
+			Payload struct {
+				Exp float64 `json:"exp"`
+			} `json:"payload"`
+		} `json:"obtainKrakenToken"`
 	} `json:"data"`
+	Errors []GraphQLError `json:"errors"`
+}
+
+type TokenCache struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	KeyHash   string    `json:"keyHash"`
+}
+
+type State struct {
+	NotifiedVouchers []string `json:"notifiedVouchers"`
+	// RemindedVouchers have also had their expiring soon reminder, see -expiry-warn
+	RemindedVouchers []string `json:"remindedVouchers,omitempty"`
+}
+
+type ArchiveRecord struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Status    int             `json:"status"`
+	Response  json.RawMessage `json:"response"`
 }
 
 type RewardResponse struct {
 	Data struct {
 		OctoplusRewards []OctoplusReward `json:"octoplusRewards"`
 	} `json:"data"`
+	Errors []GraphQLError `json:"errors"`
 }
 
 type OctoplusReward struct {
@@ -66,6 +441,132 @@ func main() {
 
 	// Set log flags to enable date and time
 	log.SetFlags(log.Ldate | log.Ltime)
+	if *redact {
+		log.SetOutput(logRedactor)
+	}
+
+	if *verbose && *quiet {
+		log.Fatalf("Error: -verbose and -quiet can't be used together")
+	}
+	if *verbose {
+		logLevel = levelDebug
+	} else if *quiet {
+		logLevel = levelWarn
+	}
+
+	if *attempts < 1 {
+		log.Fatalf("Error: -attempts must be at least 1")
+	}
+
+	if *jobs < 1 {
+		log.Fatalf("Error: -jobs must be at least 1")
+	}
+
+	for _, id := range strings.Split(*rewardIDList, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(id)
+		if err != nil || n <= 0 {
+			log.Fatalf("Error: -reward-id '%s' must be a positive number", id)
+		}
+		rewardIDs = append(rewardIDs, n)
+	}
+
+	// Bad QR settings fall back to the defaults rather than stopping the run
+	if *qrSize < 21 {
+		warnf("Invalid -qr-size %d, using 256", *qrSize)
+		*qrSize = 256
+	}
+
+	switch strings.ToLower(*qrEC) {
+	case "low":
+		qrRecoveryLevel = qrcode.Low
+	case "medium":
+		qrRecoveryLevel = qrcode.Medium
+	case "high":
+		qrRecoveryLevel = qrcode.High
+	case "highest":
+		qrRecoveryLevel = qrcode.Highest
+	default:
+		warnf("Invalid -qr-ec '%s', using medium", *qrEC)
+	}
+
+	if *qrFormat != "png" && *qrFormat != "svg" {
+		log.Fatalf("Error: -qr-format must be png or svg")
+	}
+
+	if *qrSource != "barcode" && *qrSource != "code" {
+		log.Fatalf("Error: -qr-source must be barcode or code")
+	}
+
+	if *interval < 0 {
+		log.Fatalf("Error: -interval can't be negative")
+	}
+
+	if *rewardsMode != "first" && *rewardsMode != "latest" && *rewardsMode != "all" {
+		log.Fatalf("Error: -rewards must be one of first, latest, or all")
+	}
+
+	for _, channel := range strings.Split(*notifyChannel, ",") {
+		channel = strings.TrimSpace(channel)
+		switch channel {
+		case "email", "smtp", "slack", "telegram", "pushover", "webhook":
+		default:
+			log.Fatalf("Error: -notify channels must be email, smtp, slack, telegram, pushover, or webhook, not '%s'", channel)
+		}
+
+		if !containsString(notifyChannels, channel) {
+			notifyChannels = append(notifyChannels, channel)
+		}
+	}
+
+	if *timezone != "" {
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatalf("Error: -timezone: %v", err)
+		}
+		displayLocation = loc
+	}
+
+	// Parse the body template now so a mistake fails before anything is fetched
+	var err error
+	bodyTemplate, err = loadBodyTemplate(*bodyTemplateFile)
+	if err != nil {
+		log.Fatalf("Error reading -body-template: %v", err)
+	}
+	emailTemplate, err = loadEmailTemplate(*templateFile)
+	if err != nil {
+		log.Fatalf("Error reading -template: %v", err)
+	}
+
+	normalPriority, expiringPriority, err = parsePriorities(*priority)
+	if err != nil {
+		log.Fatalf("Error parsing -priority: %v", err)
+	}
+
+	if *attachmentName != "" {
+		nameTemplate, err = texttemplate.New("attachment").Parse(*attachmentName)
+		if err != nil {
+			log.Fatalf("Error parsing -attachment-name: %v", err)
+		}
+	}
+
+	// Load any replacement GraphQL queries
+	if *authQueryFile != "" {
+		err := loadGraphQLRequest(*authQueryFile, &authRequest)
+		if err != nil {
+			log.Fatalf("Error reading -auth-query: %v", err)
+		}
+	}
+	if *rewardQueryFile != "" {
+		err := loadGraphQLRequest(*rewardQueryFile, &rewardRequest)
+		if err != nil {
+			log.Fatalf("Error reading -reward-query: %v", err)
+		}
+	}
 
 	// Read configuration file
 	config, err := readConfig(*configFile)
@@ -73,190 +574,2874 @@ func main() {
 		log.Fatalf("Error reading configuration: %v", err)
 	}
 
+	// Flags take precedence over both the environment and the configuration file
+	flagOverrides := []struct {
+		flag  *string
+		value *string
+	}{
+		{octopusKeyFlag, &config.OctopusAPIKey},
+		{mailgunDomainFlag, &config.MailgunDomain},
+		{mailgunKeyFlag, &config.MailgunApiKey},
+		{mailgunFromFlag, &config.MailgunFrom},
+		{mailgunToFlag, &config.MailgunTo},
+		{mailgunRegionFlag, &config.MailgunRegion},
+		{smtpHostFlag, &config.SMTPHost},
+		{slackWebhookFlag, &config.SlackWebhookURL},
+		{webhookURLFlag, &config.WebhookURL},
+		{telegramChatFlag, &config.TelegramChatID},
+		{pushoverUserFlag, &config.PushoverUserKey},
+	}
+	for _, override := range flagOverrides {
+		if *override.flag != "" {
+			*override.value = *override.flag
+		}
+	}
+
+	err = validateConfig(config)
+	if err != nil {
+		log.Fatalf("Error in configuration: %v", err)
+	}
+
 	// Set configuration variables
-	octopusAPIKey = config.OctopusAPIKey
 	mailgunDomain = config.MailgunDomain
 	mailgunApiKey = config.MailgunApiKey
 	mailgunFrom = config.MailgunFrom
-	mailgunTo = config.MailgunTo
 
-	// Obtain Octopus API token
-	err = getOctopusAPIToken()
+	// The -from-name flag takes precedence over the configuration file
+	fromName = config.FromName
+	if *fromNameFlag != "" {
+		fromName = *fromNameFlag
+	}
+	mailgunTo, err = parseRecipients(config.MailgunTo)
 	if err != nil {
-		log.Fatalf("Error obtaining Octopus API token: %v", err)
+		log.Fatalf("Error reading configuration: %v", err)
 	}
+	slackWebhookURL = config.SlackWebhookURL
+	mailgunRegion = strings.ToLower(config.MailgunRegion)
 
-	// Make Octoplus API request
-	reward, err := getOctoplusReward()
-	if err != nil {
-		log.Fatalf("Error getting Octoplus reward: %v", err)
+	// The -subject flag takes precedence over the configuration file, parse it now so a
+	// mistake fails before anything is fetched
+	emailSubject := config.EmailSubject
+	if *subjectTemplate != "" {
+		emailSubject = *subjectTemplate
+	}
+	if emailSubject != "" {
+		subjectTmpl, err = texttemplate.New("subject").Parse(emailSubject)
+		if err != nil {
+			log.Fatalf("Error parsing subject template: %v", err)
+		}
 	}
 
-	// Print Octoplus reward details
-	printOctoplusReward(reward)
+	// Keep the credentials out of the logs, whichever code path they turn up in
+	logRedactor.Add(config.OctopusAPIKey, config.MailgunApiKey, config.SMTPPassword, config.TelegramBotToken, config.PushoverAppToken, config.PushoverUserKey)
+	for _, value := range config.WebhookHeaders {
+		logRedactor.Add(value)
+	}
 
-	// Send the response to Mailgun's Email API
-	err = sendToMailgunEmail(reward)
-	if err != nil {
-		log.Fatalf("Error sending to Mailgun: %v", err)
+	// Route every API call through -proxy if set, otherwise HTTPS_PROXY and the like from
+	// the environment as before
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *proxy != "" {
+		proxyURL, err := url.Parse(*proxy)
+		if err != nil || proxyURL.Host == "" {
+			log.Fatalf("Error: -proxy '%s' must be a URL such as http://proxy:3128", *proxy)
+		}
+		if password, ok := proxyURL.User.Password(); ok {
+			logRedactor.Add(password)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
 	}
-}
 
-// getOctopusAPIToken obtains an API token for the Octopus Energy API
-func getOctopusAPIToken() error {
-	url := "https://api.octopus.energy/v1/graphql/"
+	// Log the raw HTTP exchanges
+	var roundTripper http.RoundTripper = transport
+	if *httpDebug {
+		roundTripper = &DebugTransport{Next: transport}
+	}
+	// No client timeout, as it's shared with the notifiers and their uploads. -timeout bounds
+	// the Octopus API requests through run's context, each notifier sets its own limit.
+	httpClient = &http.Client{Transport: roundTripper}
 
-	// Payload for authentication, adjust based on Octopus Energy API requirements
-	payload := strings.NewReader(fmt.Sprintf(`{
-		"query": "mutation krakenTokenAuthentication($key: String!) { obtainKrakenToken(input: {APIKey: $key}) { token }}",
-		"variables": {
-		  "key": "%s"
-		}
-	  }`, octopusAPIKey))
+	// Set up the Octopus API client
+	octopus := NewOctopusClient(config.OctopusAPIKey)
 
-	// Make HTTP POST request
-	resp, err := http.Post(url, "application/json", payload)
+	// Stop cleanly on Ctrl+C or SIGTERM, between or during runs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Load the vouchers already notified about, kept in memory between runs in watch mode
+	state, err := loadState(*stateFile)
 	if err != nil {
-		return fmt.Errorf("error obtaining Octopus API token: %v", err)
+		log.Fatalf("Error reading state: %v", err)
 	}
-	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading Octopus API token response body: %v", err)
+	// Set up the notification channels, fanning out when there's more than one
+	multi := MultiNotifier{}
+	for _, channel := range notifyChannels {
+		multi.Channels = append(multi.Channels, channel)
+		multi.Notifiers = append(multi.Notifiers, newNotifier(channel, config))
 	}
 
-	// Unmarshal JSON response
-	var tokenResponse TokenResponse
-	err = json.Unmarshal(body, &tokenResponse)
-	if err != nil {
-		return fmt.Errorf("error decoding Octopus API token response JSON: %v", err)
+	var notifier Notifier = multi
+	if len(multi.Notifiers) == 1 {
+		notifier = multi.Notifiers[0]
 	}
 
-	// Retrieve and store the token
-	var ok bool
-	octopusAPIToken, ok = tokenResponse.Data.ObtainKrakenToken["token"].(string)
-	if !ok {
-		return fmt.Errorf("error extracting access_token from Octopus API token response")
+	// Carry the last success over from the previous run's metrics, so alerts on it survive restarts
+	if *metricsFile != "" {
+		metrics.load(*metricsFile)
 	}
 
-	log.Printf("Octopus API token obtained: length %d", len(octopusAPIToken))
+	if *once || *interval == 0 {
+		if *metricsAddr != "" {
+			warnf("-metrics-addr is only served in watch mode, ignoring it")
+		}
 
-	return nil
+		err = run(ctx, octopus, state, notifier)
+		metrics.finish(err)
+		if err == nil {
+			touchHealthFile()
+		}
+		if err != nil {
+			if *notifyFailures {
+				reportFailure(err)
+			}
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
+	// Watch mode, errors are logged and the next run tries again. Only the first failure in
+	// a row is emailed, so a lasting outage doesn't send one every interval.
+	infof("Checking for new rewards every %s", *interval)
+
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			err := http.ListenAndServe(*metricsAddr, mux)
+			warnf("Metrics server stopped: %v", err)
+		}()
+	}
+
+	failing := false
+	for {
+		err = run(ctx, octopus, state, notifier)
+		metrics.finish(err)
+		if err == nil {
+			touchHealthFile()
+		}
+		if err != nil {
+			warnf("Run failed: %v", err)
+			if *notifyFailures && !failing {
+				reportFailure(err)
+			}
+			failing = true
+		} else {
+			failing = false
+		}
+
+		// Up to 10% jitter so runs don't line up with other scheduled clients
+		delay := *interval + time.Duration(rand.Int63n(int64(*interval)/10+1))
+		debugf("Next check in %s", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			infof("Stopping")
+			return
+		}
+	}
 }
 
-// getOctoplusReward makes an HTTP request to the Octopus Energy API
-func getOctoplusReward() (*OctoplusReward, error) {
-	url := "https://api.octopus.energy/v1/graphql/"
+// run fetches the rewards and notifies about any new vouchers
+func run(ctx context.Context, octopus *OctopusClient, state *State, notifier Notifier) error {
+	// Bound the Octopus API requests so a hung endpoint can't stall the run
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
 
-	// Payload for authentication, adjust based on Octopus Energy API requirements
-	payload := strings.NewReader(`{
-		"query": "query getOctoplusRewards($rewardId: Int) {\noctoplusRewards(rewardId: $rewardId) {\nid\npriceTag\nstatus\nvouchers {\n ... on OctoplusVoucherType {\ncode\nbarcodeValue\nbarcodeFormat\nexpiresAt}}}}"
-	  }`)
+	metrics.start()
 
-	// Make HTTP POST request
-	req, _ := http.NewRequest("POST", url, payload)
-	req.Header.Add("Authorization", octopusAPIToken)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making Octoplus API request: %v", err)
+	// Obtain Octopus API token, reusing the one from an earlier run or the cache while it's still valid
+	if octopus.Token == "" || time.Until(octopus.TokenExpiry) < tokenExpiryMargin {
+		if *noTokenCache || !octopus.loadCachedToken() {
+			err := octopus.refreshOctopusAPIToken(ctx)
+			if err != nil {
+				return fmt.Errorf("error obtaining Octopus API token: %v", err)
+			}
+		}
 	}
-	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	// Make Octoplus API request, authenticating again once if the token is rejected
+	rewards, err := octopus.fetchRewards(ctx, rewardIDs)
+	if errors.Is(err, errUnauthorized) {
+		warnf("Octopus API token rejected, obtaining a new one: %v", err)
+
+		err = octopus.refreshOctopusAPIToken(ctx)
+		if err != nil {
+			return fmt.Errorf("error obtaining Octopus API token: %v", err)
+		}
+
+		rewards, err = octopus.fetchRewards(ctx, rewardIDs)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error reading Octopus API response body: %v", err)
+		return fmt.Errorf("error getting Octoplus rewards: %v", err)
 	}
+	metrics.found(len(rewards))
 
-	// Unmarshal JSON response
-	var rewardResponse RewardResponse
-	err = json.Unmarshal(body, &rewardResponse)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding Octopus API response JSON: %v", err)
+	// Drop rewards whose status isn't wanted
+	if *statusFilter != "" {
+		rewards = filterRewardsByStatus(rewards, strings.Split(*statusFilter, ","), func(reward OctoplusReward) {
+			debugf("Filtered out reward %d with status '%s'", reward.ID, reward.Status)
+		})
+		if len(rewards) == 0 {
+			infof("No rewards matched status filter '%s', not sending notification", *statusFilter)
+			if *jsonOutput {
+				return writeRewardsJSON(rewards)
+			}
+			return nil
+		}
 	}
 
-	// Check if there are Octoplus rewards
-	if len(rewardResponse.Data.OctoplusRewards) == 0 {
-		return nil, fmt.Errorf("no Octoplus rewards found in the response")
+	// Rewards that can't be spent yet are nothing to do
+	if *claimableOnly {
+		rewards = filterRewardsByStatus(rewards, strings.Split(*claimable, ","), func(reward OctoplusReward) {
+			infof("Skipping reward %d, status '%s' isn't claimable yet", reward.ID, reward.Status)
+		})
+		if len(rewards) == 0 {
+			infof("No claimable rewards, not sending notification")
+			if *jsonOutput {
+				return writeRewardsJSON(rewards)
+			}
+			return nil
+		}
 	}
 
-	// Return the first item, this _should_ be most recent
-	return &rewardResponse.Data.OctoplusRewards[0], nil
-}
+	// Pick the rewards to send, every one asked for with -reward-id goes in the one notification
+	if len(rewardIDs) == 0 {
+		rewards = selectRewards(rewards, *rewardsMode)
+	}
+	rewards = dedupeVouchers(rewards)
 
-// printOctoplusReward prints Octoplus reward details to the console
-func printOctoplusReward(reward *OctoplusReward) {
-	log.Printf("Octopus Energy Reward\nID: %d\nPrice Tag: %s\nStatus: %s\n\nVouchers:\n", reward.ID, reward.PriceTag, reward.Status)
-	for i, voucher := range reward.Vouchers {
-		log.Printf("Voucher %d:\n", i+1)
-		log.Printf("  Code: %s\n", voucher.Code)
-		log.Printf("  Barcode Value: %s\n", voucher.BarcodeValue)
-		log.Printf("  Barcode Format: %s\n", voucher.BarcodeFormat)
-		log.Printf("  Expires At: %s\n", voucher.ExpiresAt)
+	// Print the rewards for other tools to process instead of notifying about them
+	if *jsonOutput {
+		return writeRewardsJSON(rewards)
 	}
-}
 
-// sendToMailgunEmail sends the Octopus Energy response to Twilio's WhatsApp API
-func sendToMailgunEmail(reward *OctoplusReward) error {
-	// Set up Mailgun client
-	mg := mailgun.NewMailgun(mailgunDomain, mailgunApiKey)
+	// Rewards still waiting for their vouchers to be issued aren't worth a notification
+	if !*notifyEmpty {
+		rewards = dropEmptyRewards(rewards)
+		if len(rewards) == 0 {
+			infof("No rewards with vouchers yet, not sending notification")
+			return nil
+		}
+	}
 
-	qrCodes := map[string][]byte{}
+	// Drop the vouchers already notified about. Watch mode always does this, so it doesn't
+	// re-send on every run even without a state file.
+	if *stateFile != "" || !(*once || *interval == 0) {
+		rewards = state.newVouchers(rewards)
+		if len(rewards) == 0 {
+			infof("No new vouchers since the last run, not sending notification")
+			return nil
+		}
+	}
 
-	// Prepare message body
-	messageBody := fmt.Sprintf("Octopus Energy Reward\nID: %d\nPrice Tag: %s\nStatus: %s\n\nVouchers:\n", reward.ID, reward.PriceTag, reward.Status)
-	for i, voucher := range reward.Vouchers {
-		messageBody += fmt.Sprintf("Voucher %d:\n", i+1)
-		messageBody += fmt.Sprintf("  Code: %s\n", voucher.Code)
-		messageBody += fmt.Sprintf("  Barcode Value: %s\n", voucher.BarcodeValue)
-		messageBody += fmt.Sprintf("  Barcode Format: %s\n", voucher.BarcodeFormat)
-		messageBody += fmt.Sprintf("  Expires At: %s\n", voucher.ExpiresAt)
+	// Print Octoplus reward details
+	for i := range rewards {
+		printOctoplusReward(&rewards[i])
+	}
 
-		// Generate QR code from the barcode value
-		png, err := qrcode.Encode(voucher.BarcodeValue, qrcode.Medium, 256)
+	// Save barcodes to disk
+	if *qrDir != "" {
+		err = saveBarcodes(rewards, *qrDir)
 		if err != nil {
-			return fmt.Errorf("error generating QR code: %v", err)
+			return fmt.Errorf("error saving barcodes: %v", err)
 		}
+	}
+
+	if *noEmail {
+		return nil
+	}
 
-		// Add the qrCode to the map, to be attached separately.
-		qrCodes[voucher.Code] = png
+	// Send the notification, either combined or one per reward
+	if *emailPerReward {
+		for _, reward := range rewards {
+			err = notifyRewards(notifier, state, []OctoplusReward{reward})
+			if err != nil {
+				return fmt.Errorf("error sending notification: %v", err)
+			}
+		}
+	} else {
+		err = notifyRewards(notifier, state, rewards)
+		if err != nil {
+			return fmt.Errorf("error sending notification: %v", err)
+		}
 	}
 
-	// Send email via Mailgun's API
-	message := mg.NewMessage(mailgunFrom, "Octopus API - New Reward Generated", messageBody, mailgunTo)
+	return nil
+}
 
-	// Loop through the QR codes and attach each. The name will be the voucher code.
-	for k, v := range qrCodes {
-		message.AddBufferAttachment(k, v)
+// newNotifier creates the notifier for a -notify channel
+func newNotifier(channel string, config *Config) Notifier {
+	switch channel {
+	case "slack":
+		return SlackNotifier{WebhookURL: slackWebhookURL}
+	case "smtp":
+		return SMTPNotifier{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			TLS:      strings.ToLower(config.SMTPTLS),
+		}
+	case "telegram":
+		return TelegramNotifier{BotToken: config.TelegramBotToken, ChatID: config.TelegramChatID}
+	case "pushover":
+		return PushoverNotifier{AppToken: config.PushoverAppToken, UserKey: config.PushoverUserKey}
+	case "webhook":
+		return WebhookNotifier{
+			URL:     config.WebhookURL,
+			Headers: config.WebhookHeaders,
+			Client:  &http.Client{Timeout: *webhookTimeout, Transport: httpClient.Transport},
+		}
+	default:
+		return MailgunNotifier{}
 	}
+}
 
-	// Send the message with a 10 second timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
+// reportFailure emails the error from a failed run. If that send fails too it's only logged,
+// so a broken Mailgun setup can't cause a loop of failure emails.
+func reportFailure(runErr error) {
+	err := sendFailureEmail(runErr)
+	if err != nil {
+		warnf("Error sending failure email: %v", err)
+	}
+}
 
-	resp, id, err := mg.Send(ctx, message)
+// notifyRewards sends the rewards and records their vouchers in the state once sent
+func notifyRewards(notifier Notifier, state *State, rewards []OctoplusReward) error {
+	// A channel failing when others succeeded still counts as notified, otherwise the next
+	// run would repeat the notification on the channels that worked
+	err := notifier.Notify(rewards)
+	var notifyErr *NotifyError
+	if err != nil && !(errors.As(err, &notifyErr) && len(notifyErr.Succeeded) > 0) {
+		return err
+	}
+	sendErr := err
 
-	log.Printf("Successfully sent Mailgun email, response: '%s' id: '%s'", resp, id)
+	// Nothing was actually sent, so don't record it
+	if *dryRun {
+		return sendErr
+	}
 
-	return err
+	notified, reminded := state.sets()
+	for _, reward := range rewards {
+		metrics.sent(len(reward.Vouchers))
+		for _, voucher := range reward.Vouchers {
+			key := voucherKey(voucher)
+			if !notified[key] {
+				state.NotifiedVouchers = append(state.NotifiedVouchers, key)
+				notified[key] = true
+			}
+			if expiringSoon(voucher) && !reminded[key] {
+				state.RemindedVouchers = append(state.RemindedVouchers, key)
+				reminded[key] = true
+			}
+		}
+	}
+
+	err = state.save(*stateFile)
+	if err != nil {
+		// The notification has gone, so a failed save only risks a repeat next run
+		warnf("Error saving state: %v", err)
+	}
+
+	return sendErr
 }
 
-// readConfig reads configuration from a JSON file
-func readConfig(filePath string) (*Config, error) {
-	file, err := os.Open(filePath)
+// start resets the per-run counts at the beginning of a run
+func (m *Metrics) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.RewardsFound = 0
+	m.VouchersSent = 0
+}
+
+// found records the number of rewards returned by the Octopus API
+func (m *Metrics) found(rewards int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.RewardsFound = rewards
+}
+
+// sent adds to the number of vouchers notified about
+func (m *Metrics) sent(vouchers int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.VouchersSent += vouchers
+}
+
+// finish records the run's outcome and writes the -metrics-file if set
+func (m *Metrics) finish(runErr error) {
+	m.mu.Lock()
+	m.LastRun = time.Now()
+	m.Success = runErr == nil
+	if m.Success {
+		m.LastSuccess = m.LastRun
+	}
+	text := m.text()
+	m.mu.Unlock()
+
+	if *metricsFile == "" {
+		return
+	}
+
+	// Write then rename so the collector never reads a half-written file
+	tmpPath := *metricsFile + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(text), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, *metricsFile)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error opening configuration file: %v", err)
+		warnf("Error writing metrics file: %v", err)
 	}
-	defer file.Close()
+}
 
-	decoder := json.NewDecoder(file)
-	config := &Config{}
-	err = decoder.Decode(config)
+// load reads the last success time from an earlier metrics file, if there is one
+func (m *Metrics) load(filePath string) {
+	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding configuration JSON: %v", err)
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		value, found := strings.CutPrefix(line, "octoplus_last_success_timestamp_seconds ")
+		if !found {
+			continue
+		}
+
+		seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err == nil && seconds > 0 {
+			m.LastSuccess = time.Unix(seconds, 0)
+		}
+	}
+}
+
+// text formats the metrics in the Prometheus text exposition format. The caller holds m.mu.
+func (m *Metrics) text() string {
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+	success := 0
+	if m.Success {
+		success = 1
+	}
+
+	var b strings.Builder
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"octoplus_last_run_timestamp_seconds", "Time the last run finished.", unix(m.LastRun)},
+		{"octoplus_last_success_timestamp_seconds", "Time the last successful run finished.", unix(m.LastSuccess)},
+		{"octoplus_last_run_success", "Whether the last run succeeded.", int64(success)},
+		{"octoplus_rewards_found", "Rewards returned by the Octopus API in the last run.", int64(m.RewardsFound)},
+		{"octoplus_vouchers_sent", "Vouchers notified about in the last run.", int64(m.VouchersSent)},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", metric.name, metric.help, metric.name, metric.name, metric.value)
+	}
+
+	return b.String()
+}
+
+// ServeHTTP serves the metrics for -metrics-addr
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	text := m.text()
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, text)
+}
+
+// touchHealthFile writes the current time to the -health-file after a successful run
+func touchHealthFile() {
+	if *healthFile == "" {
+		return
+	}
+
+	tmpPath := *healthFile + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(time.Now().Format(time.RFC3339)+"\n"), 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, *healthFile)
+	}
+	if err != nil {
+		warnf("Error writing health file: %v", err)
+	}
+}
+
+// loadState reads the state file, starting empty if it hasn't been written yet
+func loadState(filePath string) (*State, error) {
+	state := &State{}
+	if filePath == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %v", err)
+	}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding state file JSON: %v", err)
+	}
+
+	return state, nil
+}
+
+// save writes the state atomically, so an interrupted run can't leave it truncated, and like
+// the archive it's readable only by the current user, since the voucher codes can be spent
+func (s *State) save(filePath string) error {
+	if filePath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding state: %v", err)
+	}
+
+	tmpPath := filePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing state file: %v", err)
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
+
+// sets returns the notified and reminded voucher keys as sets
+func (s *State) sets() (map[string]bool, map[string]bool) {
+	notified := map[string]bool{}
+	for _, code := range s.NotifiedVouchers {
+		notified[code] = true
+	}
+
+	reminded := map[string]bool{}
+	for _, code := range s.RemindedVouchers {
+		reminded[code] = true
+	}
+
+	return notified, reminded
+}
+
+// newVouchers drops vouchers already notified about, along with any reward left with none.
+// A known voucher that's now expiring soon is kept once more as a reminder.
+func (s *State) newVouchers(rewards []OctoplusReward) []OctoplusReward {
+	notified, reminded := s.sets()
+
+	var fresh []OctoplusReward
+	for _, reward := range rewards {
+		var vouchers []OctoplusVoucher
+		for _, voucher := range reward.Vouchers {
+			key := voucherKey(voucher)
+			if !notified[key] || (expiringSoon(voucher) && !reminded[key]) {
+				vouchers = append(vouchers, voucher)
+			}
+		}
+
+		if len(vouchers) > 0 {
+			reward.Vouchers = vouchers
+			fresh = append(fresh, reward)
+		}
+	}
+
+	return fresh
+}
+
+// NewOctopusClient creates a client for the Octopus Energy API using the default HTTP client
+func NewOctopusClient(apiKey string) *OctopusClient {
+	return &OctopusClient{
+		HTTPClient: httpClient,
+		BaseURL:    octopusGraphQLURL,
+		APIKey:     apiKey,
+	}
+}
+
+// refreshOctopusAPIToken obtains a new Octopus API token and caches it for later runs
+func (c *OctopusClient) refreshOctopusAPIToken(ctx context.Context) error {
+	err := c.getOctopusAPIToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !*noTokenCache {
+		err = c.saveCachedToken()
+		if err != nil {
+			warnf("Error caching Octopus API token: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// getOctopusAPIToken obtains an API token for the Octopus Energy API
+func (c *OctopusClient) getOctopusAPIToken(ctx context.Context) error {
+	// Payload for authentication, adjust based on Octopus Energy API requirements
+	payload, err := json.Marshal(authRequest.withVariable("key", c.APIKey))
+	if err != nil {
+		return fmt.Errorf("error encoding Octopus API token request: %v", err)
+	}
+
+	// Make HTTP POST request
+	body, _, err := c.postGraphQL(ctx, string(payload), "")
+	if err != nil {
+		return fmt.Errorf("error obtaining Octopus API token: %v", err)
+	}
+
+	// Unmarshal JSON response, a token of the wrong type fails here naming the type received
+	var tokenResponse TokenResponse
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return fmt.Errorf("error decoding Octopus API token response JSON: %v", err)
+	}
+
+	if len(tokenResponse.Errors) > 0 {
+		return fmt.Errorf("error from Octopus API token request: %s", tokenResponse.Errors[0].Message)
+	}
+
+	// Retrieve and store the token
+	token := tokenResponse.Data.ObtainKrakenToken
+	if token.Token == "" {
+		return fmt.Errorf("error extracting token from Octopus API token response: no token returned")
+	}
+	c.Token = token.Token
+	logRedactor.Add(c.Token)
+
+	// Without an expiry the token is used for this run but not cached
+	c.TokenExpiry = time.Time{}
+	if token.Payload.Exp > 0 {
+		c.TokenExpiry = time.Unix(int64(token.Payload.Exp), 0)
+	}
+
+	debugf("Octopus API token obtained")
+
+	return nil
+}
+
+// loadCachedToken reuses the cached Octopus API token if it was issued for the
+// configured API key and isn't about to expire
+func (c *OctopusClient) loadCachedToken() bool {
+	data, err := os.ReadFile(*tokenCacheFile)
+	if err != nil {
+		return false
+	}
+
+	var cache TokenCache
+	err = json.Unmarshal(data, &cache)
+	if err != nil {
+		warnf("Ignoring unreadable token cache: %v", err)
+		return false
+	}
+
+	if cache.Token == "" || cache.KeyHash != c.apiKeyHash() || time.Until(cache.ExpiresAt) < tokenExpiryMargin {
+		return false
+	}
+
+	c.Token = cache.Token
+	logRedactor.Add(c.Token)
+	c.TokenExpiry = cache.ExpiresAt
+
+	debugf("Using cached Octopus API token, expires %s", cache.ExpiresAt.Format(time.RFC3339))
+
+	return true
+}
+
+// saveCachedToken writes the Octopus API token to the cache file, readable only by the
+// current user since it's a credential
+func (c *OctopusClient) saveCachedToken() error {
+	// Without an expiry we can't tell when the token stops working, so don't cache it
+	if c.TokenExpiry.IsZero() {
+		return nil
+	}
+
+	data, err := json.Marshal(TokenCache{
+		Token:     c.Token,
+		ExpiresAt: c.TokenExpiry,
+		KeyHash:   c.apiKeyHash(),
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding token cache: %v", err)
+	}
+
+	err = os.WriteFile(*tokenCacheFile, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing token cache: %v", err)
+	}
+
+	// WriteFile only applies the permissions when creating the file
+	return os.Chmod(*tokenCacheFile, 0600)
+}
+
+// apiKeyHash identifies the API key a cached token belongs to without storing the key itself
+func (c *OctopusClient) apiKeyHash() string {
+	sum := sha256.Sum256([]byte(c.APIKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// getOctoplusRewards makes an HTTP request to the Octopus Energy API
+func (c *OctopusClient) getOctoplusRewards(ctx context.Context, rewardID int) ([]OctoplusReward, error) {
+	// Payload for the rewards query
+	request := rewardRequest
+	if rewardID != 0 {
+		request = request.withVariable("rewardId", rewardID)
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding Octoplus API request: %v", err)
+	}
+
+	// Make HTTP POST request
+	body, status, err := c.postGraphQL(ctx, string(payload), c.Token)
+	if err != nil {
+		return nil, fmt.Errorf("error making Octoplus API request: %w", err)
+	}
+
+	// Keep exactly what the API returned, before anything is filtered out
+	if *archiveDir != "" {
+		err = archiveResponse(*archiveDir, rewardID, status, body)
+		if err != nil {
+			warnf("Error archiving Octoplus API response: %v", err)
+		}
+	}
+
+	// Unmarshal JSON response
+	var rewardResponse RewardResponse
+	err = json.Unmarshal(body, &rewardResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding Octopus API response JSON: %v", err)
+	}
+
+	if len(rewardResponse.Errors) > 0 {
+		if authErrorCodes[rewardResponse.Errors[0].Extensions.ErrorCode] {
+			return nil, fmt.Errorf("%w: %s", errUnauthorized, rewardResponse.Errors[0].Message)
+		}
+		return nil, fmt.Errorf("error from Octoplus API request: %s", rewardResponse.Errors[0].Message)
+	}
+
+	// Check if there are Octoplus rewards
+	if len(rewardResponse.Data.OctoplusRewards) == 0 {
+		return nil, fmt.Errorf("no Octoplus rewards found in the response")
+	}
+
+	// Make sure the API honoured the requested reward, and didn't return others alongside it
+	if rewardID != 0 {
+		for _, reward := range rewardResponse.Data.OctoplusRewards {
+			if reward.ID == rewardID {
+				return []OctoplusReward{reward}, nil
+			}
+		}
+		return nil, fmt.Errorf("reward %d not found in the response", rewardID)
+	}
+
+	return rewardResponse.Data.OctoplusRewards, nil
+}
+
+// fetchRewards gets all the rewards, or each of rewardIDs with up to -jobs requests at once.
+// The token is only read while fetching, refreshing it is left to the caller.
+func (c *OctopusClient) fetchRewards(ctx context.Context, rewardIDs []int) ([]OctoplusReward, error) {
+	if len(rewardIDs) == 0 {
+		return c.getOctoplusRewards(ctx, 0)
+	}
+
+	// Each fetch writes only its own slot, so the results keep the -reward-id order
+	results := make([][]OctoplusReward, len(rewardIDs))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(*jobs)
+	for i, id := range rewardIDs {
+		i, id := i, id
+		group.Go(func() error {
+			start := time.Now()
+			rewards, err := c.getOctoplusRewards(ctx, id)
+			debugf("Fetched reward %d in %s", id, time.Since(start).Round(time.Millisecond))
+			if err != nil {
+				return fmt.Errorf("reward %d: %w", id, err)
+			}
+
+			results[i] = rewards
+			return nil
+		})
+	}
+
+	err := group.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	var rewards []OctoplusReward
+	for _, result := range results {
+		rewards = append(rewards, result...)
+	}
+
+	return rewards, nil
+}
+
+// archiveResponse writes a rewards response to a timestamped file in dir, readable only by
+// the current user since it holds voucher codes. Responses for a single reward also carry
+// its ID in the name, as they're fetched at the same time.
+func archiveResponse(dir string, rewardID int, status int, body []byte) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating archive directory: %v", err)
+	}
+
+	record := ArchiveRecord{
+		FetchedAt: time.Now().UTC(),
+		Status:    status,
+		Response:  body,
+	}
+
+	// A response that isn't valid JSON can't be embedded as-is, so keep it as a string
+	if !json.Valid(body) {
+		record.Response, _ = json.Marshal(string(body))
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding archive record: %v", err)
+	}
+
+	name := "rewards-" + record.FetchedAt.Format("20060102T150405.000Z")
+	if rewardID != 0 {
+		name += "-" + strconv.Itoa(rewardID)
+	}
+	filePath := filepath.Join(dir, name+".json")
+	err = os.WriteFile(filePath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing archive file: %v", err)
+	}
+
+	debugf("Archived rewards response to %s", filePath)
+
+	return nil
+}
+
+// filterRewardsByStatus keeps only the rewards with one of the allowed statuses, calling
+// skipped with each one dropped so the caller can log it
+func filterRewardsByStatus(rewards []OctoplusReward, statuses []string, skipped func(OctoplusReward)) []OctoplusReward {
+	var filtered []OctoplusReward
+	for _, reward := range rewards {
+		allowed := false
+		for _, status := range statuses {
+			if strings.EqualFold(strings.TrimSpace(status), reward.Status) {
+				allowed = true
+				break
+			}
+		}
+
+		if allowed {
+			filtered = append(filtered, reward)
+		} else {
+			skipped(reward)
+		}
+	}
+
+	return filtered
+}
+
+// writeRewardsJSON prints the rewards to stdout as a JSON array, empty rather than null when
+// there are none
+func writeRewardsJSON(rewards []OctoplusReward) error {
+	if rewards == nil {
+		rewards = []OctoplusReward{}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(rewards)
+	if err != nil {
+		return fmt.Errorf("error writing rewards JSON: %v", err)
+	}
+
+	return nil
+}
+
+// voucherKey identifies a voucher by its code, or by its barcode value when it has no code
+func voucherKey(voucher OctoplusVoucher) string {
+	if voucher.Code == "" {
+		return voucher.BarcodeValue
+	}
+	return voucher.Code
+}
+
+// dedupeVouchers drops vouchers already seen under an earlier reward, matching on voucherKey.
+// Rewards left with no vouchers are dropped.
+func dedupeVouchers(rewards []OctoplusReward) []OctoplusReward {
+	seen := map[string]bool{}
+
+	var deduped []OctoplusReward
+	for _, reward := range rewards {
+		var vouchers []OctoplusVoucher
+		for _, voucher := range reward.Vouchers {
+			key := voucherKey(voucher)
+			if seen[key] {
+				debugf("Skipping duplicate voucher %s in reward %d", key, reward.ID)
+				continue
+			}
+			seen[key] = true
+			vouchers = append(vouchers, voucher)
+		}
+
+		if len(vouchers) == 0 && len(reward.Vouchers) > 0 {
+			continue
+		}
+
+		reward.Vouchers = vouchers
+		deduped = append(deduped, reward)
+	}
+
+	return deduped
+}
+
+// dropEmptyRewards drops rewards that have no vouchers yet
+func dropEmptyRewards(rewards []OctoplusReward) []OctoplusReward {
+	var withVouchers []OctoplusReward
+	for _, reward := range rewards {
+		if len(reward.Vouchers) == 0 {
+			infof("Skipping reward %d with status '%s', it has no vouchers yet", reward.ID, reward.Status)
+			continue
+		}
+		withVouchers = append(withVouchers, reward)
+	}
+
+	return withVouchers
+}
+
+// selectRewards picks the rewards to send according to the -rewards mode
+func selectRewards(rewards []OctoplusReward, mode string) []OctoplusReward {
+	switch mode {
+	case "all":
+		return rewards
+	case "latest":
+		// Reward IDs increase over time, so the highest is the most recent
+		latest := rewards[0]
+		for _, reward := range rewards[1:] {
+			if reward.ID > latest.ID {
+				latest = reward
+			}
+		}
+		return []OctoplusReward{latest}
+	default:
+		// The first item as returned by the API, this _should_ be most recent
+		return rewards[:1]
+	}
+}
+
+// withVariable returns a copy of the request with the variable set, leaving the original as is
+func (r GraphQLRequest) withVariable(name string, value interface{}) GraphQLRequest {
+	variables := map[string]interface{}{}
+	for k, v := range r.Variables {
+		variables[k] = v
+	}
+	variables[name] = value
+
+	r.Variables = variables
+	return r
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date, returning
+// zero if it's absent, unreadable or in the past, and at most maxRetryAfter
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	var wait time.Duration
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else {
+		t, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+		wait = time.Until(t)
+	}
+
+	switch {
+	case wait < 0:
+		return 0
+	case wait > maxRetryAfter:
+		return maxRetryAfter
+	default:
+		return wait
+	}
+}
+
+// loadGraphQLRequest reads a GraphQL request body from a JSON file
+func loadGraphQLRequest(filePath string, request *GraphQLRequest) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error reading query file: %v", err)
+	}
+
+	var loaded GraphQLRequest
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return fmt.Errorf("error decoding query file JSON: %v", err)
+	}
+
+	if strings.TrimSpace(loaded.Query) == "" {
+		return fmt.Errorf("query file %s has no \"query\"", filePath)
+	}
+
+	*request = loaded
+
+	return nil
+}
+
+// postGraphQL posts a GraphQL payload to the Octopus API and returns the response body.
+// Network errors and 5xx responses are retried with exponential backoff, other
+// failures are returned straight away as retrying won't help.
+func (c *OctopusClient) postGraphQL(ctx context.Context, payload string, token string) ([]byte, int, error) {
+	// Some Kraken endpoints want the token prefixed with a scheme such as Bearer
+	authorization := token
+	if *authScheme != "" {
+		authorization = *authScheme + " " + token
+	}
+
+	var lastErr error
+	var retryAfter time.Duration
+	for attempt := 1; attempt <= *attempts; attempt++ {
+		if attempt > 1 {
+			delay := *retryBackoff << (attempt - 2)
+			if retryAfter > 0 {
+				delay = retryAfter
+			}
+			warnf("Retrying Octopus API request in %s (attempt %d of %d): %v", delay, attempt, *attempts, lastErr)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, 0, fmt.Errorf("giving up after %d attempts: %v", attempt-1, ctx.Err())
+			}
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL, strings.NewReader(payload))
+		if err != nil {
+			return nil, 0, fmt.Errorf("error creating request: %v", err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Add("Authorization", authorization)
+		}
+
+		debugf("POST %s (attempt %d of %d)", c.BaseURL, attempt, *attempts)
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			// Once the deadline has passed there's no point retrying
+			if ctx.Err() != nil {
+				return nil, 0, fmt.Errorf("error making request: %v", err)
+			}
+			lastErr = err
+			continue
+		}
+
+		// Read response body
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("error reading response body: %v", err)
+			continue
+		}
+
+		debugf("Octopus API responded %s, %d bytes", resp.Status, len(body))
+
+		// Rate limited or overloaded, wait as long as the API asks before trying again
+		retryAfter = 0
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			if resp.StatusCode == http.StatusTooManyRequests {
+				lastErr = fmt.Errorf("rate limited: %s", resp.Status)
+				continue
+			}
+		}
+
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+			continue
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, 0, fmt.Errorf("%w: %s %s", errUnauthorized, resp.Status, body)
+		}
+
+		if resp.StatusCode >= 400 {
+			return nil, 0, fmt.Errorf("request rejected: %s %s", resp.Status, body)
+		}
+
+		return body, resp.StatusCode, nil
+	}
+
+	return nil, 0, fmt.Errorf("giving up after %d attempts: %v", *attempts, lastErr)
+}
+
+// printOctoplusReward prints Octoplus reward details to the console
+func printOctoplusReward(reward *OctoplusReward) {
+	infof("Octopus Energy Reward\nID: %d\nPrice Tag: %s\nStatus: %s\n\nVouchers:\n", reward.ID, reward.PriceTag, reward.Status)
+	for i, voucher := range reward.Vouchers {
+		infof("Voucher %d:\n", i+1)
+		infof("  Code: %s\n", voucher.Code)
+		infof("  Barcode Value: %s\n", voucher.BarcodeValue)
+		infof("  Barcode Format: %s\n", voucher.BarcodeFormat)
+		infof("  Expires At: %s\n", formatExpiry(voucher.ExpiresAt))
+		if formatExpiry(voucher.ExpiresAt) != voucher.ExpiresAt {
+			infof("  Expires At (raw): %s\n", voucher.ExpiresAt)
+		}
+	}
+}
+
+// Notify sends the rewards to every channel, carrying on past failures so one broken
+// channel doesn't stop the rest
+func (m MultiNotifier) Notify(rewards []OctoplusReward) error {
+	result := &NotifyError{Failed: map[string]error{}}
+	for i, notifier := range m.Notifiers {
+		err := notifier.Notify(rewards)
+		if err != nil {
+			warnf("Error sending %s notification: %v", m.Channels[i], err)
+			result.Failed[m.Channels[i]] = err
+		} else {
+			result.Succeeded = append(result.Succeeded, m.Channels[i])
+		}
+	}
+
+	infof("Notified via %d of %d channels, succeeded: [%s]", len(result.Succeeded), len(m.Notifiers), strings.Join(result.Succeeded, ", "))
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+
+	return nil
+}
+
+// Error lists each failed channel with its error
+func (e *NotifyError) Error() string {
+	var failed []string
+	for channel, err := range e.Failed {
+		failed = append(failed, fmt.Sprintf("%s: %v", channel, err))
+	}
+	sort.Strings(failed)
+
+	return fmt.Sprintf("%d channel(s) failed: %s", len(e.Failed), strings.Join(failed, "; "))
+}
+
+// Notify emails the rewards via Mailgun
+func (MailgunNotifier) Notify(rewards []OctoplusReward) error {
+	return sendToMailgunEmail(rewards)
+}
+
+// Notify posts the rewards to the Slack webhook. Incoming webhooks can't carry files, so
+// the barcodes aren't included; use -qr-dir alongside to keep them.
+func (n SlackNotifier) Notify(rewards []OctoplusReward) error {
+	// Prepare message text in Slack's mrkdwn format
+	text := ""
+	for _, reward := range rewards {
+		if text != "" {
+			text += "\n\n"
+		}
+
+		text += fmt.Sprintf("*Octopus Energy Reward %d*\nPrice Tag: %s\nStatus: %s", reward.ID, reward.PriceTag, reward.Status)
+		if len(reward.Vouchers) == 0 {
+			text += "\n_No vouchers yet_"
+		}
+		for _, voucher := range reward.Vouchers {
+			text += fmt.Sprintf("\n• `%s` expires %s", voucher.Code, formatExpiry(voucher.ExpiresAt))
+		}
+	}
+
+	if *dryRun {
+		infof("Dry run, not posting to Slack\n%s", text)
+		return nil
+	}
+
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("error encoding Slack message: %v", err)
+	}
+
+	// Post the message with a 10 second timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", n.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error creating Slack request: %v", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to Slack: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error posting to Slack: %s %s", resp.Status, body)
+	}
+
+	infof("Successfully posted to Slack")
+
+	return nil
+}
+
+// Notify sends the rewards to the Telegram chat as text, split to fit Telegram's message
+// limit, followed by a photo of each voucher's barcode
+func (n TelegramNotifier) Notify(rewards []OctoplusReward) error {
+	text := ""
+	for _, reward := range rewards {
+		if text != "" {
+			text += "\n\n"
+		}
+
+		text += fmt.Sprintf("Octopus Energy Reward %d\nPrice Tag: %s\nStatus: %s", reward.ID, reward.PriceTag, reward.Status)
+		if len(reward.Vouchers) == 0 {
+			text += "\nNo vouchers yet"
+		}
+		for _, voucher := range reward.Vouchers {
+			text += fmt.Sprintf("\n• %s expires %s", voucher.Code, formatExpiry(voucher.ExpiresAt))
+		}
+	}
+
+	if *dryRun {
+		infof("Dry run, not sending to Telegram chat %s\n%s", n.ChatID, text)
+		return nil
+	}
+
+	for _, chunk := range splitMessage(text, telegramMessageLimit) {
+		payload, err := json.Marshal(map[string]string{"chat_id": n.ChatID, "text": chunk})
+		if err != nil {
+			return fmt.Errorf("error encoding Telegram message: %v", err)
+		}
+
+		err = n.call("sendMessage", "application/json", payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Telegram photos must be raster images, so always send png barcodes
+	barcodes, err := generateBarcodesAs(rewards, "png")
+	if err != nil {
+		return err
+	}
+
+	for _, reward := range rewards {
+		for _, voucher := range reward.Vouchers {
+			var body bytes.Buffer
+			w := multipart.NewWriter(&body)
+			w.WriteField("chat_id", n.ChatID)
+			w.WriteField("caption", voucher.Code)
+
+			part, err := w.CreateFormFile("photo", filepath.Base(voucherKey(voucher))+".png")
+			if err != nil {
+				return fmt.Errorf("error building Telegram photo upload: %v", err)
+			}
+			part.Write(barcodes[voucherKey(voucher)])
+
+			err = w.Close()
+			if err != nil {
+				return fmt.Errorf("error building Telegram photo upload: %v", err)
+			}
+
+			err = n.call("sendPhoto", w.FormDataContentType(), body.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	infof("Successfully sent to Telegram chat %s", n.ChatID)
+
+	return nil
+}
+
+// call posts a request to a Telegram Bot API method, returning Telegram's description of
+// any failure. The bot token is part of the URL, so it's kept out of the errors.
+func (n TelegramNotifier) call(method string, contentType string, body []byte) error {
+	// Post the request with a 10 second timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", telegramAPIURL+"/bot"+n.BotToken+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating Telegram %s request", method)
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error calling Telegram %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("error decoding Telegram %s response: %s", method, resp.Status)
+	}
+
+	if !result.OK {
+		return fmt.Errorf("error from Telegram %s: %s %s", method, resp.Status, result.Description)
+	}
+
+	return nil
+}
+
+// Notify sends one Pushover notification per reward, at the -priority for expiring vouchers
+// if any expire soon. Server errors are retried, but hitting the app's message limit isn't.
+func (n PushoverNotifier) Notify(rewards []OctoplusReward) error {
+	for _, reward := range rewards {
+		message := fmt.Sprintf("Price Tag: %s\nStatus: %s", reward.PriceTag, reward.Status)
+		if len(reward.Vouchers) == 0 {
+			message += "\nNo vouchers yet"
+		}
+
+		level := normalPriority
+		for _, voucher := range reward.Vouchers {
+			message += fmt.Sprintf("\n%s expires %s", voucher.Code, formatExpiry(voucher.ExpiresAt))
+			if expiringSoon(voucher) {
+				level = expiringPriority
+			}
+		}
+
+		// Pushover rejects messages over 1024 characters rather than truncating them
+		if runes := []rune(message); len(runes) > 1024 {
+			message = string(runes[:1023]) + "…"
+		}
+
+		fields := map[string]string{
+			"token":    n.AppToken,
+			"user":     n.UserKey,
+			"title":    fmt.Sprintf("Octopus Energy Reward %d", reward.ID),
+			"message":  message,
+			"priority": strconv.Itoa(level),
+		}
+
+		// Emergency notifications repeat until acknowledged, every minute for up to an hour
+		if level == 2 {
+			fields["retry"] = "60"
+			fields["expire"] = "3600"
+		}
+
+		if *dryRun {
+			infof("Dry run, not sending Pushover notification at priority %d\n%s", level, message)
+			continue
+		}
+
+		var image []byte
+		if *pushoverAttach && len(reward.Vouchers) > 0 {
+			// Pushover only shows raster images
+			data, err := encodeBarcode(reward.Vouchers[0], "png")
+			if err != nil {
+				return fmt.Errorf("error generating barcode for voucher %s: %v", reward.Vouchers[0].Code, err)
+			}
+			image = data
+		}
+
+		err := n.send(fields, image)
+		if err != nil {
+			return err
+		}
+	}
+
+	infof("Successfully sent %d Pushover notification(s)", len(rewards))
+
+	return nil
+}
+
+// send posts one message to Pushover as a multipart form, retrying server errors
+func (n PushoverNotifier) send(fields map[string]string, image []byte) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for k, v := range fields {
+		w.WriteField(k, v)
+	}
+	if image != nil {
+		part, err := w.CreateFormFile("attachment", "barcode.png")
+		if err != nil {
+			return fmt.Errorf("error building Pushover request: %v", err)
+		}
+		part.Write(image)
+	}
+	err := w.Close()
+	if err != nil {
+		return fmt.Errorf("error building Pushover request: %v", err)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= *attempts; attempt++ {
+		if attempt > 1 {
+			delay := *retryBackoff << (attempt - 2)
+			warnf("Retrying Pushover in %s (attempt %d of %d): %v", delay, attempt, *attempts, lastErr)
+			time.Sleep(delay)
+		}
+
+		// Post the message with a 10 second timeout
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		req, err := http.NewRequestWithContext(ctx, "POST", pushoverAPIURL, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			cancel()
+			return fmt.Errorf("error creating Pushover request: %v", err)
+		}
+		req.Header.Add("Content-Type", w.FormDataContentType())
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			cancel()
+			lastErr = err
+			continue
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+
+		// The app's monthly message allowance is used up, retrying won't help until it resets
+		if resp.StatusCode == http.StatusTooManyRequests {
+			reset := "the start of next month"
+			if unix, err := strconv.ParseInt(resp.Header.Get("X-Limit-App-Reset"), 10, 64); err == nil {
+				reset = time.Unix(unix, 0).Format(time.RFC1123)
+			}
+			return fmt.Errorf("pushover message limit reached, resets at %s", reset)
+		}
+
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("error from Pushover: %s %s", resp.Status, respBody)
+		}
+
+		if remaining, err := strconv.Atoi(resp.Header.Get("X-Limit-App-Remaining")); err == nil && remaining < 100 {
+			warnf("Only %d Pushover messages left this month", remaining)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("error sending to Pushover, giving up after %d attempts: %v", *attempts, lastErr)
+}
+
+// parsePriorities reads the -priority mapping, e.g. normal=0,expiring=1. Either may be
+// left out to keep its default.
+func parsePriorities(s string) (int, int, error) {
+	priorities := map[string]int{"normal": 0, "expiring": 1}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if _, known := priorities[name]; !found || !known {
+			return 0, 0, fmt.Errorf("'%s' must be normal=<priority> or expiring=<priority>", pair)
+		}
+
+		level, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || level < -2 || level > 2 {
+			return 0, 0, fmt.Errorf("priority '%s' must be a number from -2 to 2", value)
+		}
+		priorities[name] = level
+	}
+
+	return priorities["normal"], priorities["expiring"], nil
+}
+
+// splitMessage splits text into chunks of at most limit characters, breaking between lines
+// where possible
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+	chunk := ""
+	for _, line := range strings.SplitAfter(text, "\n") {
+		// Lines longer than the limit have to be broken mid-line
+		for utf8.RuneCountInString(line) > limit {
+			if chunk != "" {
+				chunks = append(chunks, chunk)
+				chunk = ""
+			}
+			runes := []rune(line)
+			chunks = append(chunks, string(runes[:limit]))
+			line = string(runes[limit:])
+		}
+
+		if utf8.RuneCountInString(chunk)+utf8.RuneCountInString(line) > limit {
+			chunks = append(chunks, chunk)
+			chunk = ""
+		}
+		chunk += line
+	}
+	if chunk != "" {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// Notify posts the rewards to the webhook as a JSON document, retrying server errors
+func (n WebhookNotifier) Notify(rewards []OctoplusReward) error {
+	payload, err := json.Marshal(struct {
+		Rewards []OctoplusReward `json:"rewards"`
+	}{rewards})
+	if err != nil {
+		return fmt.Errorf("error encoding webhook payload: %v", err)
+	}
+
+	if *dryRun {
+		infof("Dry run, not posting to webhook %s\n%s", n.URL, payload)
+		return nil
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= *attempts; attempt++ {
+		if attempt > 1 {
+			delay := *retryBackoff << (attempt - 2)
+			warnf("Retrying webhook in %s (attempt %d of %d): %v", delay, attempt, *attempts, lastErr)
+			time.Sleep(delay)
+		}
+
+		req, err := http.NewRequest("POST", n.URL, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("error creating webhook request: %v", err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		for k, v := range n.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := n.Client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+			continue
+		}
+
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook rejected: %s %s", resp.Status, body)
+		}
+
+		infof("Successfully posted to webhook %s", n.URL)
+		return nil
+	}
+
+	return fmt.Errorf("error posting to webhook, giving up after %d attempts: %v", *attempts, lastErr)
+}
+
+// fromHeader gives the email From header, adding the -from-name display name if set
+func fromHeader() string {
+	if fromName == "" {
+		return mailgunFrom
+	}
+
+	// mailgunFrom has already been validated, and may carry its own name to replace
+	address, err := mail.ParseAddress(mailgunFrom)
+	if err != nil {
+		return mailgunFrom
+	}
+
+	return (&mail.Address{Name: fromName, Address: address.Address}).String()
+}
+
+// buildEmail renders the rewards into the email sent by both the Mailgun and SMTP notifiers
+func buildEmail(rewards []OctoplusReward) (*Email, error) {
+	if len(rewards) == 0 {
+		return nil, fmt.Errorf("no rewards to send")
+	}
+
+	rewards = sortVouchersByExpiry(rewards)
+	fetchedAt := time.Now().In(displayLocation).Format("Mon 2 Jan 2006 15:04 MST")
+
+	// Prepare message body
+	var body bytes.Buffer
+	err := bodyTemplate.Execute(&body, struct {
+		Rewards   []OctoplusReward
+		Label     string
+		FetchedAt string
+	}{rewards, *label, fetchedAt})
+	if err != nil {
+		return nil, fmt.Errorf("error rendering body template: %v", err)
+	}
+	messageBody := body.String()
+
+	barcodes, err := generateBarcodes(rewards)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := attachmentNames(rewards)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody, err := renderEmailHTML(rewards, fetchedAt, names)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := renderSubject(rewards, fetchedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if *label != "" {
+		subject = "[" + *label + "] " + subject
+	}
+
+	// Flag the whole email if any voucher in it is about to lapse
+	soon := false
+	for _, reward := range rewards {
+		for _, voucher := range reward.Vouchers {
+			soon = soon || expiringSoon(voucher)
+		}
+	}
+	if soon {
+		subject = "⚠ expiring soon: " + subject
+	}
+
+	email := &Email{
+		Subject:     subject,
+		Text:        messageBody,
+		HTML:        htmlBody,
+		Inline:      map[string][]byte{},
+		Attachments: map[string][]byte{},
+	}
+
+	// Barcodes are inlined so the HTML body can reference them by filename
+	for code, data := range barcodes {
+		email.Inline[names[code]] = data
+	}
+
+	if *pdfSummary {
+		// The PDF needs PNGs, so SVG barcodes are rendered again for it
+		images := barcodes
+		if *qrFormat != "png" {
+			images, err = generateBarcodesAs(rewards, "png")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pdf, err := generatePDF(rewards, images)
+		if err != nil {
+			return nil, err
+		}
+		email.Attachments["vouchers.pdf"] = pdf
+	}
+
+	if *icsReminder {
+		if ics := generateICS(rewards); ics != nil {
+			email.Attachments["reminder.ics"] = ics
+		}
+	}
+
+	return email, nil
+}
+
+// newMailgunClient sets up the Mailgun client for the configured domain and region
+func newMailgunClient() *mailgun.MailgunImpl {
+	mg := mailgun.NewMailgun(mailgunDomain, mailgunApiKey)
+	mg.SetClient(httpClient)
+
+	// EU domains are only served by the EU API, the US one rejects them
+	if mailgunRegion == "eu" {
+		mg.SetAPIBase(mailgun.APIBaseEU)
+	}
+
+	return mg
+}
+
+// checkMailgunDomain looks the domain up in the selected Mailgun region before the first send,
+// since a domain in the other region only gets a bare 401 from Send. If the lookup fails in
+// both regions the key may just lack permission to read domains, so the send goes ahead.
+func checkMailgunDomain() error {
+	if mailgunChecked {
+		return nil
+	}
+	mailgunChecked = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, err := newMailgunClient().GetDomain(ctx, mailgunDomain)
+	if err == nil {
+		debugf("Mailgun domain %s found", mailgunDomain)
+		return nil
+	}
+
+	region, other, otherBase := "US", "EU", mailgun.APIBaseEU
+	if mailgunRegion == "eu" {
+		region, other, otherBase = "EU", "US", mailgun.APIBaseUS
+	}
+
+	mg := mailgun.NewMailgun(mailgunDomain, mailgunApiKey)
+	mg.SetClient(httpClient)
+	mg.SetAPIBase(otherBase)
+	_, otherErr := mg.GetDomain(ctx, mailgunDomain)
+	if otherErr == nil {
+		return fmt.Errorf("mailgun domain %s not found in %s region; did you mean %s? Set -mailgun-region=%s", mailgunDomain, region, other, strings.ToLower(other))
+	}
+
+	warnf("Couldn't verify Mailgun domain %s in the %s region, sending anyway: %v", mailgunDomain, region, err)
+	return nil
+}
+
+// sendMailgun sends a message built by newMessage, retrying network errors and Mailgun server
+// errors with backoff. The message is rebuilt for each attempt as its inline readers are consumed.
+func sendMailgun(mg *mailgun.MailgunImpl, newMessage func() *mailgun.Message) (string, string, error) {
+	var lastErr error
+	for attempt := 1; attempt <= *attempts; attempt++ {
+		if attempt > 1 {
+			delay := *retryBackoff << (attempt - 2)
+			warnf("Retrying Mailgun send in %s (attempt %d of %d): %v", delay, attempt, *attempts, lastErr)
+			time.Sleep(delay)
+		}
+
+		debugf("Sending Mailgun email (attempt %d of %d)", attempt, *attempts)
+
+		// Send the message with a 10 second timeout
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		resp, id, err := mg.Send(ctx, newMessage())
+		cancel()
+		if err == nil {
+			return resp, id, nil
+		}
+
+		// Client errors such as a bad API key or recipient won't succeed on retry
+		var respErr *mailgun.UnexpectedResponseError
+		if errors.As(err, &respErr) && respErr.Actual < 500 && respErr.Actual != http.StatusTooManyRequests {
+			return "", "", err
+		}
+		lastErr = err
+	}
+
+	return "", "", fmt.Errorf("giving up after %d attempts: %v", *attempts, lastErr)
+}
+
+// sendFailureEmail sends a short email via Mailgun reporting why the run failed
+func sendFailureEmail(runErr error) error {
+	subject := "Octopus API - Run Failed"
+	body := fmt.Sprintf("The Octoplus rewards check failed at %s:\n\n%v\n", time.Now().Format(time.RFC1123), runErr)
+
+	if *dryRun {
+		infof("Dry run, not sending failure email to %s\nSubject: %s\n%s", strings.Join(mailgunTo, ", "), subject, body)
+		return nil
+	}
+
+	mg := newMailgunClient()
+	_, _, err := sendMailgun(mg, func() *mailgun.Message {
+		return mg.NewMessage(fromHeader(), subject, body, mailgunTo...)
+	})
+	if err != nil {
+		return err
+	}
+
+	infof("Sent failure email to %s", strings.Join(mailgunTo, ", "))
+
+	return nil
+}
+
+// sendToMailgunEmail sends the Octopus Energy rewards in a single email via Mailgun's API
+func sendToMailgunEmail(rewards []OctoplusReward) error {
+	// Set up Mailgun client
+	mg := newMailgunClient()
+
+	email, err := buildEmail(rewards)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		infof("Dry run, not sending email to %s\nSubject: %s\nAttachments: %d\n%s", strings.Join(mailgunTo, ", "), email.Subject, len(email.Inline)+len(email.Attachments), email.Text)
+		return nil
+	}
+
+	// Checking the domain is a Mailgun API call too, so a dry run skips it
+	err = checkMailgunDomain()
+	if err != nil {
+		return err
+	}
+
+	// Send email via Mailgun's API, with the plain text body as the fallback for text-only clients
+	resp, id, err := sendMailgun(mg, func() *mailgun.Message {
+		message := mg.NewMessage(fromHeader(), email.Subject, email.Text, mailgunTo...)
+		message.SetHtml(email.HTML)
+
+		for k, v := range email.Inline {
+			message.AddReaderInline(k, io.NopCloser(bytes.NewReader(v)))
+		}
+
+		for k, v := range email.Attachments {
+			message.AddBufferAttachment(k, v)
+		}
+
+		return message
+	})
+	if err != nil {
+		return fmt.Errorf("error sending Mailgun email: %v", err)
+	}
+
+	infof("Successfully sent Mailgun email to %s, response: '%s' id: '%s'", strings.Join(mailgunTo, ", "), resp, id)
+
+	return nil
+}
+
+// Notify emails the rewards through the SMTP server
+func (n SMTPNotifier) Notify(rewards []OctoplusReward) error {
+	email, err := buildEmail(rewards)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		infof("Dry run, not sending email via %s to %s\nSubject: %s\nAttachments: %d\n%s", n.Host, strings.Join(mailgunTo, ", "), email.Subject, len(email.Inline)+len(email.Attachments), email.Text)
+		return nil
+	}
+
+	message, err := email.mime(fromHeader(), mailgunTo)
+	if err != nil {
+		return fmt.Errorf("error building email: %v", err)
+	}
+
+	// The envelope sender is just the address, without any display name
+	from, err := mail.ParseAddress(mailgunFrom)
+	if err != nil {
+		return fmt.Errorf("error reading from address: %v", err)
+	}
+
+	err = n.send(from.Address, mailgunTo, message)
+	if err != nil {
+		return fmt.Errorf("error sending SMTP email: %v", err)
+	}
+
+	infof("Successfully sent SMTP email via %s to %s", n.Host, strings.Join(mailgunTo, ", "))
+
+	return nil
+}
+
+// send delivers the message over SMTP with a 10 second deadline for the whole exchange
+func (n SMTPNotifier) send(from string, to []string, message []byte) error {
+	port := n.Port
+	if port == 0 {
+		port = 587
+		if n.TLS == "tls" {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: n.Host}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if n.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	client, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if n.TLS == "" || n.TLS == "starttls" {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(message)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// mime encodes the email as a MIME message: the text and HTML bodies as alternatives, with
+// the inline images alongside them and any attachments after
+func (e *Email) mime(from string, to []string) ([]byte, error) {
+	// Build the nested multiparts from the inside out, each becomes a part of the next
+	alternative, altType, err := multipartBody("alternative", func(w *multipart.Writer) error {
+		err := writePart(w, "text/plain; charset=utf-8", nil, []byte(e.Text))
+		if err != nil {
+			return err
+		}
+		return writePart(w, "text/html; charset=utf-8", nil, []byte(e.HTML))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	related, relatedType, err := multipartBody("related", func(w *multipart.Writer) error {
+		err := writeRawPart(w, altType, alternative)
+		if err != nil {
+			return err
+		}
+		for name, data := range e.Inline {
+			err = writePart(w, mime.TypeByExtension(filepath.Ext(name)), textproto.MIMEHeader{
+				"Content-Id":          {"<" + name + ">"},
+				"Content-Disposition": {mime.FormatMediaType("inline", map[string]string{"filename": name})},
+			}, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mixed, mixedType, err := multipartBody("mixed", func(w *multipart.Writer) error {
+		err := writeRawPart(w, relatedType, related)
+		if err != nil {
+			return err
+		}
+		for name, data := range e.Attachments {
+			err = writePart(w, mime.TypeByExtension(filepath.Ext(name)), textproto.MIMEHeader{
+				"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			}, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: %s\r\n\r\n", mixedType)
+	buf.Write(mixed)
+
+	return buf.Bytes(), nil
+}
+
+// multipartBody writes a multipart/<subtype> body, returning it with its Content-Type
+func multipartBody(subtype string, write func(w *multipart.Writer) error) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	err := write(w)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), "multipart/" + subtype + "; boundary=" + w.Boundary(), nil
+}
+
+// writeRawPart adds an already encoded nested multipart as a part
+func writeRawPart(w *multipart.Writer, contentType string, body []byte) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+
+	_, err = part.Write(body)
+	return err
+}
+
+// writePart adds a base64 encoded part, wrapped at 76 characters as MIME requires
+func writePart(w *multipart.Writer, contentType string, header textproto.MIMEHeader, body []byte) error {
+	if header == nil {
+		header = textproto.MIMEHeader{}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(body)
+	for len(encoded) > 76 {
+		_, err = io.WriteString(part, encoded[:76]+"\r\n")
+		if err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+// generatePDF builds a printable summary with each voucher's details and barcode image
+func generatePDF(rewards []OctoplusReward, barcodes map[string][]byte) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Octoplus Vouchers", true)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AddPage()
+
+	// The core fonts are cp1252, which covers the £ in price tags
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, "Octoplus Vouchers", "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	for _, reward := range rewards {
+		for _, voucher := range reward.Vouchers {
+			key := voucherKey(voucher)
+			data, ok := barcodes[key]
+			if !ok {
+				continue
+			}
+
+			info := pdf.RegisterImageOptionsReader(key, gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(data))
+			if pdf.Err() {
+				return nil, fmt.Errorf("error adding barcode for voucher %s to PDF: %v", voucher.Code, pdf.Error())
+			}
+
+			// Square codes are 40mm, linear barcodes 80mm wide, keeping their aspect ratio
+			width := 40.0
+			if info.Width() > info.Height()*2 {
+				width = 80.0
+			}
+			height := width * info.Height() / info.Width()
+
+			// Keep a voucher's details and barcode together on one page
+			_, pageHeight := pdf.GetPageSize()
+			if pdf.GetY()+height+25 > pageHeight-15 {
+				pdf.AddPage()
+			}
+
+			pdf.SetFont("Helvetica", "B", 14)
+			pdf.CellFormat(0, 7, tr(voucher.Code), "", 1, "L", false, 0, "")
+			pdf.SetFont("Helvetica", "", 11)
+			pdf.CellFormat(0, 6, tr(fmt.Sprintf("%s - Expires %s", reward.PriceTag, formatExpiry(voucher.ExpiresAt))), "", 1, "L", false, 0, "")
+
+			pdf.ImageOptions(key, pdf.GetX(), pdf.GetY()+2, width, height, false, gofpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+			pdf.SetY(pdf.GetY() + height + 10)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("error generating PDF: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// generateICS builds an RFC 5545 calendar with a reminder event -ics-days before each
+// voucher expires. Vouchers whose expiry can't be parsed are skipped.
+func generateICS(rewards []OctoplusReward) []byte {
+	now := time.Now().UTC().Format("20060102T150405Z")
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//JoeEcob//octoplus-greggs//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+	}
+	events := 0
+	for _, reward := range rewards {
+		for _, voucher := range reward.Vouchers {
+			expiresAt, err := parseExpiry(voucher.ExpiresAt)
+			if err != nil {
+				warnf("Skipping ICS reminder for voucher %s, unreadable expiry '%s': %v", voucher.Code, voucher.ExpiresAt, err)
+				continue
+			}
+
+			// Times are written in UTC so calendars convert them to the reader's timezone
+			start := expiresAt.UTC().AddDate(0, 0, -*icsDays)
+
+			lines = append(lines,
+				"BEGIN:VEVENT",
+				"UID:"+icsEscape(voucher.Code)+"@octoplus-greggs",
+				"DTSTAMP:"+now,
+				"DTSTART:"+start.Format("20060102T150405Z"),
+				"DTEND:"+start.Add(30*time.Minute).Format("20060102T150405Z"),
+				"SUMMARY:"+icsEscape(fmt.Sprintf("Use Octoplus voucher %s (%s)", voucher.Code, reward.PriceTag)),
+				"DESCRIPTION:"+icsEscape(fmt.Sprintf("Voucher %s expires %s", voucher.Code, expiresAt.Format(time.RFC1123))),
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				"DESCRIPTION:"+icsEscape("Octoplus voucher "+voucher.Code+" expires soon"),
+				"TRIGGER:-PT0M",
+				"END:VALARM",
+				"END:VEVENT",
+			)
+			events++
+		}
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	if events == 0 {
+		return nil
+	}
+
+	// Lines end in CRLF and are folded at 75 octets
+	var buf bytes.Buffer
+	for _, line := range lines {
+		// Continuation lines start with a space, which counts towards the limit
+		limit := 75
+		for len(line) > limit {
+			cut := limit
+			// Don't split a multi-byte character
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			buf.WriteString(line[:cut] + "\r\n ")
+			line = line[cut:]
+			limit = 74
+		}
+		buf.WriteString(line + "\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+// icsEscape escapes a TEXT value for an ICS property
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(text)
+}
+
+// parseExpiry parses a voucher's expiresAt timestamp
+func parseExpiry(expiresAt string) (time.Time, error) {
+	return time.Parse(time.RFC3339, expiresAt)
+}
+
+// formatExpiry renders an expiry timestamp in the -timezone and -expiry-layout with how long
+// is left, leaving unreadable values as they are
+func formatExpiry(expiresAt string) string {
+	return formatExpiryAt(expiresAt, time.Now())
+}
+
+// formatExpiryAt is formatExpiry as of now. Days left count calendar days in the -timezone,
+// so a voucher expiring tomorrow morning isn't "today" when it's evening.
+func formatExpiryAt(expiresAt string, now time.Time) string {
+	t, err := parseExpiry(expiresAt)
+	if err != nil {
+		return expiresAt
+	}
+
+	local := t.In(displayLocation)
+	if t.Before(now) {
+		return local.Format(*expiryLayout) + " (expired)"
+	}
+
+	switch days := calendarDays(now.In(displayLocation), local); days {
+	case 0:
+		return local.Format(*expiryLayout) + " (expires today)"
+	case 1:
+		return local.Format(*expiryLayout) + " (expires in 1 day)"
+	default:
+		return fmt.Sprintf("%s (expires in %d days)", local.Format(*expiryLayout), days)
+	}
+}
+
+// calendarDays counts the midnights between from and to in their own location. The dates
+// are compared as UTC days so a daylight saving change can't leave a day of 23 or 25 hours.
+func calendarDays(from time.Time, to time.Time) int {
+	fromDay := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	toDay := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC)
+	return int(toDay.Sub(fromDay) / (24 * time.Hour))
+}
+
+// expiringSoon reports whether the voucher expires within the -expiry-warn window
+func expiringSoon(voucher OctoplusVoucher) bool {
+	if *expiryWarn <= 0 {
+		return false
+	}
+
+	t, err := parseExpiry(voucher.ExpiresAt)
+	if err != nil {
+		return false
+	}
+
+	left := time.Until(t)
+	return left > 0 && left <= *expiryWarn
+}
+
+// sortVouchersByExpiry orders each reward's vouchers soonest-expiring first, with unreadable
+// expiries last. The rewards are copied so the caller's slices aren't reordered.
+func sortVouchersByExpiry(rewards []OctoplusReward) []OctoplusReward {
+	sorted := make([]OctoplusReward, len(rewards))
+	for i, reward := range rewards {
+		vouchers := append([]OctoplusVoucher(nil), reward.Vouchers...)
+		sort.SliceStable(vouchers, func(a, b int) bool {
+			ta, errA := parseExpiry(vouchers[a].ExpiresAt)
+			tb, errB := parseExpiry(vouchers[b].ExpiresAt)
+			if errA != nil || errB != nil {
+				return errA == nil && errB != nil
+			}
+			return ta.Before(tb)
+		})
+
+		reward.Vouchers = vouchers
+		sorted[i] = reward
+	}
+
+	return sorted
+}
+
+// loadBodyTemplate parses the plain text body template from the file, or the built-in one if
+// no file is given. expiry and expiringSoon are as for the HTML template, and inc adds one to
+// an index for numbering.
+func loadBodyTemplate(filePath string) (*texttemplate.Template, error) {
+	text := defaultBodyTemplate
+	if filePath != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading body template: %v", err)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := texttemplate.New("body").Funcs(texttemplate.FuncMap{
+		"expiry":       formatExpiry,
+		"expiringSoon": expiringSoon,
+		"inc":          func(i int) int { return i + 1 },
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing body template: %v", err)
+	}
+
+	return tmpl, nil
+}
+
+// renderSubject evaluates the subject template against the first reward, with all of them
+// available as .Rewards for combined emails, and .Label and .FetchedAt from -label
+func renderSubject(rewards []OctoplusReward, fetchedAt string) (string, error) {
+	if subjectTmpl == nil {
+		return defaultEmailSubject, nil
+	}
+
+	data := struct {
+		OctoplusReward
+		Rewards   []OctoplusReward
+		Label     string
+		FetchedAt string
+	}{rewards[0], rewards, *label, fetchedAt}
+
+	var buf bytes.Buffer
+	err := subjectTmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("error rendering subject template: %v", err)
+	}
+
+	// A stray newline would break the header
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// loadEmailTemplate parses the HTML email template from the file, or the built-in one if no
+// file is given. barcodeSrc gives the cid: URL of a voucher's inlined barcode, expiry formats
+// an expiry timestamp like the plain text body, and expiringSoon reports whether a voucher is
+// within -expiry-warn of expiring.
+func loadEmailTemplate(filePath string) (*template.Template, error) {
+	text := defaultEmailTemplate
+	if filePath != "" {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading email template: %v", err)
+		}
+		text = string(data)
+	}
+
+	tmpl, err := template.New("email").Funcs(template.FuncMap{
+		// Replaced with the attachment names for each email in renderEmailHTML
+		"barcodeSrc":   func(voucher interface{}) template.URL { return "" },
+		"expiry":       formatExpiry,
+		"expiringSoon": expiringSoon,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing email template: %v", err)
+	}
+
+	return tmpl, nil
+}
+
+// renderEmailHTML renders the HTML email body from the template parsed at startup, pointing
+// barcodeSrc at the barcode attachments in names
+func renderEmailHTML(rewards []OctoplusReward, fetchedAt string, names map[string]string) (string, error) {
+	tmpl, err := emailTemplate.Clone()
+	if err != nil {
+		return "", fmt.Errorf("error preparing email template: %v", err)
+	}
+
+	tmpl.Funcs(template.FuncMap{
+		// html/template rejects unknown URL schemes, so mark cid: URLs as safe
+		// barcodeSrc takes the voucher, or just its code as older templates pass
+		"barcodeSrc": func(voucher interface{}) template.URL {
+			key, _ := voucher.(string)
+			if v, ok := voucher.(OctoplusVoucher); ok {
+				key = voucherKey(v)
+			}
+			return template.URL("cid:" + names[key])
+		},
+	})
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, struct {
+		Rewards   []OctoplusReward
+		Label     string
+		FetchedAt string
+	}{rewards, *label, fetchedAt})
+	if err != nil {
+		return "", fmt.Errorf("error rendering email template: %v", err)
+	}
+
+	return buf.String(), nil
+}
+
+// generateBarcodes renders each voucher's barcode value as a -qr-format image, keyed by voucher code
+func generateBarcodes(rewards []OctoplusReward) (map[string][]byte, error) {
+	return generateBarcodesAs(rewards, *qrFormat)
+}
+
+// generateBarcodesAs renders each voucher's barcode value as a png or svg image, keyed by voucherKey
+func generateBarcodesAs(rewards []OctoplusReward, imageFormat string) (map[string][]byte, error) {
+	barcodes := map[string][]byte{}
+	for _, reward := range rewards {
+		for _, voucher := range reward.Vouchers {
+			data, err := encodeBarcode(voucher, imageFormat)
+			if err != nil {
+				return nil, fmt.Errorf("error generating barcode for voucher %s: %v", voucher.Code, err)
+			}
+
+			barcodes[voucherKey(voucher)] = data
+		}
+	}
+
+	return barcodes, nil
+}
+
+// encodeBarcode renders the voucher in its own barcode symbology so till scanners can read
+// it, falling back to a QR code when the format is unknown. The image is a png or svg.
+func encodeBarcode(voucher OctoplusVoucher, imageFormat string) ([]byte, error) {
+	// Formats come through as e.g. CODE_128, EAN13 or QR_CODE
+	format := strings.ToUpper(strings.NewReplacer("_", "", "-", "", " ", "").Replace(voucher.BarcodeFormat))
+
+	// Some partners scan the voucher code rather than the barcode value
+	value := voucher.BarcodeValue
+	if *qrSource == "code" {
+		value = voucher.Code
+	}
+
+	var bc barcode.Barcode
+	var err error
+	switch format {
+	case "CODE128":
+		bc, err = code128.Encode(value)
+	case "CODE39":
+		bc, err = code39.Encode(value, true, true)
+	case "CODE93":
+		bc, err = code93.Encode(value, true, true)
+	case "EAN13", "EAN8", "EAN":
+		bc, err = ean.Encode(value)
+	case "DATAMATRIX":
+		bc, err = datamatrix.Encode(value)
+	case "PDF417":
+		bc, err = pdf417.Encode(value, 4)
+	case "AZTEC":
+		bc, err = aztec.Encode([]byte(value), aztec.DEFAULT_EC_PERCENT, aztec.DEFAULT_LAYERS)
+	default:
+		if format != "" && format != "QR" && format != "QRCODE" {
+			warnf("Unknown barcode format '%s' for voucher %s, using a QR code", voucher.BarcodeFormat, voucher.Code)
+		}
+		if imageFormat == "svg" {
+			q, err := qrcode.New(value, qrRecoveryLevel)
+			if err != nil {
+				return nil, err
+			}
+			return modulesSVG(q.Bitmap(), *qrSize, *qrSize), nil
+		}
+		return qrcode.Encode(value, qrRecoveryLevel, *qrSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Linear barcodes are one module high, so stretch them into a wide strip
+	width, height := 256, 256
+	if bc.Bounds().Dy() == 1 {
+		width, height = 512, 128
+	}
+
+	if imageFormat == "svg" {
+		return modulesSVG(barcodeModules(bc), width, height), nil
+	}
+
+	bc, err = barcode.Scale(bc, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Barcodes are 16-bit, which PDF readers such as gofpdf can't embed, so flatten to 8-bit gray
+	gray := image.NewGray(bc.Bounds())
+	draw.Draw(gray, gray.Bounds(), bc, bc.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, gray)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// barcodeModules reads an unscaled barcode into a grid of dark modules
+func barcodeModules(bc barcode.Barcode) [][]bool {
+	bounds := bc.Bounds()
+	modules := make([][]bool, bounds.Dy())
+	for y := range modules {
+		modules[y] = make([]bool, bounds.Dx())
+		for x := range modules[y] {
+			r, g, b, _ := bc.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			modules[y][x] = r+g+b < 3*0x8000
+		}
+	}
+
+	return modules
+}
+
+// modulesSVG draws a grid of dark modules as an SVG of the given display size, merging each
+// row's runs of dark modules into one rect to keep the file small
+func modulesSVG(modules [][]bool, width, height int) []byte {
+	columns := 0
+	if len(modules) > 0 {
+		columns = len(modules[0])
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" preserveAspectRatio="none" shape-rendering="crispEdges">`, width, height, columns, len(modules))
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/>`, columns, len(modules))
+	for y, row := range modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&buf, `<rect x="%d" y="%d" width="%d" height="1"/>`, start, y, x-start)
+		}
+	}
+	buf.WriteString("</svg>\n")
+
+	return buf.Bytes()
+}
+
+// saveBarcodes writes each voucher's barcode image to <dir>/<code>.<format>
+func saveBarcodes(rewards []OctoplusReward, dir string) error {
+	barcodes, err := generateBarcodes(rewards)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating barcode directory: %v", err)
+	}
+
+	for code, data := range barcodes {
+		filePath := filepath.Join(dir, barcodeFilename(code))
+		err = os.WriteFile(filePath, data, 0644)
+		if err != nil {
+			return fmt.Errorf("error writing barcode: %v", err)
+		}
+
+		infof("Saved barcode to %s", filePath)
+	}
+
+	return nil
+}
+
+// attachmentNames names each voucher's barcode attachment from the -attachment-name template,
+// keyed by voucherKey. Names are made safe for filenames and unique within the email.
+func attachmentNames(rewards []OctoplusReward) (map[string]string, error) {
+	names := map[string]string{}
+	used := map[string]bool{}
+	for _, reward := range rewards {
+		for _, voucher := range reward.Vouchers {
+			key := voucherKey(voucher)
+			name := barcodeFilename(key)
+			if nameTemplate != nil {
+				var buf bytes.Buffer
+				err := nameTemplate.Execute(&buf, struct {
+					OctoplusVoucher
+					RewardID int
+					PriceTag string
+					Format   string
+				}{voucher, reward.ID, reward.PriceTag, *qrFormat})
+				if err != nil {
+					return nil, fmt.Errorf("error rendering attachment name: %v", err)
+				}
+				name = sanitizeFilename(buf.String())
+			}
+
+			// Number any repeats, keeping the extension last
+			unique := name
+			for i := 2; used[unique]; i++ {
+				ext := filepath.Ext(name)
+				unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+			}
+			used[unique] = true
+			names[key] = unique
+		}
+	}
+
+	return names, nil
+}
+
+// sanitizeFilename replaces characters that aren't safe in filenames on common systems
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "barcode"
+	}
+
+	return name
+}
+
+// barcodeFilename names a voucher's barcode image, Base guards against a code containing a
+// path separator
+func barcodeFilename(code string) string {
+	return filepath.Base(code) + "." + *qrFormat
+}
+
+// parseRecipients splits a comma-separated list of email addresses, checking each is valid
+func parseRecipients(list string) ([]string, error) {
+	var recipients []string
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		_, err := mail.ParseAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient '%s': %v", address, err)
+		}
+
+		recipients = append(recipients, address)
+	}
+
+	return recipients, nil
+}
+
+// validateConfig checks the settings needed for this run are present and well-formed
+func validateConfig(config *Config) error {
+	// The notifier settings are only needed for the selected channel
+	required := []struct {
+		name      string
+		env       string
+		value     string
+		notifiers []string
+	}{
+		{"octopusAPIKey", "OCTOPUS_API_KEY", config.OctopusAPIKey, nil},
+		{"mailgunDomain", "MAILGUN_DOMAIN", config.MailgunDomain, []string{"email"}},
+		{"mailgunApiKey", "MAILGUN_API_KEY", config.MailgunApiKey, []string{"email"}},
+		{"mailgunFrom", "MAILGUN_FROM", config.MailgunFrom, []string{"email", "smtp"}},
+		{"mailgunTo", "MAILGUN_TO", config.MailgunTo, []string{"email", "smtp"}},
+		{"smtpHost", "SMTP_HOST", config.SMTPHost, []string{"smtp"}},
+		{"slackWebhookURL", "SLACK_WEBHOOK_URL", config.SlackWebhookURL, []string{"slack"}},
+		{"telegramBotToken", "TELEGRAM_BOT_TOKEN", config.TelegramBotToken, []string{"telegram"}},
+		{"telegramChatID", "TELEGRAM_CHAT_ID", config.TelegramChatID, []string{"telegram"}},
+		{"pushoverAppToken", "PUSHOVER_APP_TOKEN", config.PushoverAppToken, []string{"pushover"}},
+		{"pushoverUserKey", "PUSHOVER_USER_KEY", config.PushoverUserKey, []string{"pushover"}},
+		{"webhookURL", "WEBHOOK_URL", config.WebhookURL, []string{"webhook"}},
+	}
+	for _, r := range required {
+		needed := r.notifiers == nil
+		for _, notifier := range r.notifiers {
+			if containsString(notifyChannels, notifier) && !*noEmail && !*jsonOutput {
+				needed = true
+			}
+
+			// Failure emails always go through Mailgun
+			if notifier == "email" && *notifyFailures {
+				needed = true
+			}
+		}
+
+		if r.value == "" && needed {
+			return fmt.Errorf("%s must be set in the configuration file or the %s environment variable", r.name, r.env)
+		}
+	}
+
+	switch strings.ToLower(config.SMTPTLS) {
+	case "", "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("smtpTLS '%s' must be starttls, tls, or none", config.SMTPTLS)
+	}
+
+	switch strings.ToLower(config.MailgunRegion) {
+	case "", "us", "eu":
+	default:
+		return fmt.Errorf("mailgunRegion '%s' must be us or eu", config.MailgunRegion)
+	}
+
+	if config.MailgunFrom != "" {
+		_, err := mail.ParseAddress(config.MailgunFrom)
+		if err != nil {
+			return fmt.Errorf("mailgunFrom '%s' is not a valid email address: %v", config.MailgunFrom, err)
+		}
+	}
+
+	_, err := parseRecipients(config.MailgunTo)
+	if err != nil {
+		return fmt.Errorf("mailgunTo: %v", err)
+	}
+
+	if config.SlackWebhookURL != "" {
+		u, err := url.Parse(config.SlackWebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("slackWebhookURL '%s' is not a valid https URL", config.SlackWebhookURL)
+		}
+	}
+
+	if config.WebhookURL != "" {
+		u, err := url.Parse(config.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhookURL '%s' is not a valid http(s) URL", config.WebhookURL)
+		}
+	}
+
+	return nil
+}
+
+// containsString reports whether the list includes s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RoundTrip logs the request, sends it on, then logs the response and restores its body
+func (t *DebugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	headers := req.Header.Clone()
+	if headers.Get("Authorization") != "" {
+		headers.Set("Authorization", "****")
+	}
+	var buf bytes.Buffer
+	headers.Write(&buf)
+	log.Printf("HTTP %s %s\n%s", req.Method, req.URL, t.redact(buf.String()))
+
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		log.Printf("HTTP %s %s failed: %v", req.Method, req.URL, err)
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	log.Printf("HTTP %s from %s\n%s", resp.Status, req.URL, t.redact(string(body)))
+
+	return resp, nil
+}
+
+// redact masks any Octopus API token in s, with -redact the log output masks the rest
+func (t *DebugTransport) redact(s string) string {
+	return tokenPattern.ReplaceAllString(s, `$1"****"`)
+}
+
+// Add registers secret values to mask. Very short values are skipped, as masking them
+// would mangle unrelated log text.
+func (w *RedactingWriter) Add(secrets ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, secret := range secrets {
+		if len(secret) >= 4 && !containsString(w.secrets, secret) {
+			w.secrets = append(w.secrets, secret)
+		}
+	}
+}
+
+// Write masks the secrets in the log line and writes it out
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	line := string(p)
+	for _, secret := range w.secrets {
+		line = strings.ReplaceAll(line, secret, "****")
+	}
+	w.mu.Unlock()
+
+	_, err := io.WriteString(w.Out, line)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// debugf logs detail only wanted with -verbose
+func debugf(format string, args ...interface{}) {
+	if logLevel <= levelDebug {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+// infof logs normal progress, hidden by -quiet
+func infof(format string, args ...interface{}) {
+	if logLevel <= levelInfo {
+		log.Printf(format, args...)
+	}
+}
+
+// warnf logs problems that don't stop the run, always shown
+func warnf(format string, args ...interface{}) {
+	log.Printf("WARNING "+format, args...)
+}
+
+// readConfig reads configuration from a JSON file, then applies any overrides from the
+// environment. The file may be absent if everything is set in the environment.
+func readConfig(filePath string) (*Config, error) {
+	config := &Config{}
+
+	// "-" reads the configuration from stdin, e.g. streamed in by a secrets manager
+	if filePath == "-" {
+		err := json.NewDecoder(os.Stdin).Decode(config)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding configuration JSON from stdin: %v", err)
+		}
+	} else if file, err := os.Open(filePath); os.IsNotExist(err) {
+		infof("Configuration file %s not found, using environment variables only", filePath)
+	} else if err != nil {
+		return nil, fmt.Errorf("error opening configuration file: %v", err)
+	} else {
+		defer file.Close()
+
+		decoder := json.NewDecoder(file)
+		err = decoder.Decode(config)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding configuration JSON: %v", err)
+		}
+	}
+
+	// Environment variables take precedence over the file
+	envOverrides := []struct {
+		name  string
+		value *string
+	}{
+		{"OCTOPUS_API_KEY", &config.OctopusAPIKey},
+		{"MAILGUN_DOMAIN", &config.MailgunDomain},
+		{"MAILGUN_API_KEY", &config.MailgunApiKey},
+		{"MAILGUN_FROM", &config.MailgunFrom},
+		{"MAILGUN_TO", &config.MailgunTo},
+		{"MAILGUN_REGION", &config.MailgunRegion},
+		{"SLACK_WEBHOOK_URL", &config.SlackWebhookURL},
+		{"TELEGRAM_BOT_TOKEN", &config.TelegramBotToken},
+		{"TELEGRAM_CHAT_ID", &config.TelegramChatID},
+		{"PUSHOVER_APP_TOKEN", &config.PushoverAppToken},
+		{"PUSHOVER_USER_KEY", &config.PushoverUserKey},
+		{"WEBHOOK_URL", &config.WebhookURL},
+		{"SMTP_HOST", &config.SMTPHost},
+		{"SMTP_USERNAME", &config.SMTPUsername},
+		{"SMTP_PASSWORD", &config.SMTPPassword},
+		{"SMTP_TLS", &config.SMTPTLS},
+	}
+	for _, env := range envOverrides {
+		if value := os.Getenv(env.name); value != "" {
+			*env.value = value
+		}
 	}
 
 	return config, nil
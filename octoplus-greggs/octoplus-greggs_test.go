@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns an Octopus client pointed at a test server running handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *OctopusClient {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := NewOctopusClient("test-key")
+	client.HTTPClient = server.Client()
+	client.BaseURL = server.URL
+
+	return client
+}
+
+func TestPostGraphQLRetryAfter(t *testing.T) {
+	// A tiny backoff, so only honouring Retry-After can make the retry wait
+	defer func(backoff time.Duration) { *retryBackoff = backoff }(*retryBackoff)
+	*retryBackoff = time.Millisecond
+
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter func() string
+		minWait    time.Duration
+	}{
+		{"429 seconds", http.StatusTooManyRequests, func() string { return "1" }, 900 * time.Millisecond},
+		{"503 seconds", http.StatusServiceUnavailable, func() string { return "1" }, 900 * time.Millisecond},
+		{"429 HTTP date", http.StatusTooManyRequests, func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, 900 * time.Millisecond},
+		{"503 HTTP date", http.StatusServiceUnavailable, func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }, 900 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.Header().Set("Retry-After", test.retryAfter())
+					w.WriteHeader(test.status)
+					return
+				}
+				w.Write([]byte(`{"data":{}}`))
+			})
+
+			start := time.Now()
+			body, status, err := client.postGraphQL(context.Background(), "{}", "token")
+			waited := time.Since(start)
+			if err != nil {
+				t.Fatalf("postGraphQL error: %v", err)
+			}
+			if status != http.StatusOK || string(body) != `{"data":{}}` {
+				t.Errorf("postGraphQL = %d %q, want the second response", status, body)
+			}
+			if calls != 2 {
+				t.Errorf("server called %d times, want 2", calls)
+			}
+			if waited < test.minWait {
+				t.Errorf("retried after %s, want at least %s from Retry-After", waited, test.minWait)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("30"); got != 30*time.Second {
+		t.Errorf("parseRetryAfter(30) = %s, want 30s", got)
+	}
+
+	got := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter of a date a minute away = %s, want about 1m", got)
+	}
+
+	// Waits far in the future are capped, ones in the past don't wait at all
+	capped := []string{"86400", time.Now().Add(48 * time.Hour).UTC().Format(http.TimeFormat)}
+	for _, value := range capped {
+		if got := parseRetryAfter(value); got != maxRetryAfter {
+			t.Errorf("parseRetryAfter(%q) = %s, want the %s cap", value, got, maxRetryAfter)
+		}
+	}
+
+	for _, value := range []string{"", "soon", "-", "-30", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %s, want 0", value, got)
+		}
+	}
+}
+
+func TestGetOctopusAPIToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		token   string
+		expiry  time.Time
+		wantErr string
+	}{
+		{"token and expiry", `{"data":{"obtainKrakenToken":{"token":"abc123","payload":{"exp":1790000000}}}}`, "abc123", time.Unix(1790000000, 0), ""},
+		{"token without expiry", `{"data":{"obtainKrakenToken":{"token":"abc123"}}}`, "abc123", time.Time{}, ""},
+		{"no token", `{"data":{"obtainKrakenToken":{"token":""}}}`, "", time.Time{}, "no token returned"},
+		{"GraphQL error", `{"errors":[{"message":"Invalid API key"}]}`, "", time.Time{}, "Invalid API key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var auth string
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				w.Write([]byte(test.body))
+			})
+
+			err := client.getOctopusAPIToken(context.Background())
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("getOctopusAPIToken error = %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getOctopusAPIToken error: %v", err)
+			}
+			if auth != "" {
+				t.Errorf("token request sent Authorization %q, want none", auth)
+			}
+			if client.Token != test.token || !client.TokenExpiry.Equal(test.expiry) {
+				t.Errorf("got token %q expiring %s, want %q expiring %s", client.Token, client.TokenExpiry, test.token, test.expiry)
+			}
+		})
+	}
+}
+
+func TestGetOctoplusRewards(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		wantErr string
+		unauth  bool
+	}{
+		{"rewards", `{"data":{"octoplusRewards":[{"id":1,"status":"CLAIMED"},{"id":2,"status":"CLAIMABLE"}]}}`, 2, "", false},
+		{"empty rewards", `{"data":{"octoplusRewards":[]}}`, 0, "no Octoplus rewards found", false},
+		{"GraphQL error", `{"errors":[{"message":"Something went wrong"}]}`, 0, "Something went wrong", false},
+		{"expired token", `{"errors":[{"message":"Token has expired","extensions":{"errorCode":"KT-CT-1124"}}]}`, 0, "Token has expired", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			})
+			client.Token = "abc123"
+
+			rewards, err := client.getOctoplusRewards(context.Background(), 0)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("getOctoplusRewards error = %v, want one containing %q", err, test.wantErr)
+				}
+				if errors.Is(err, errUnauthorized) != test.unauth {
+					t.Errorf("errors.Is(err, errUnauthorized) = %t, want %t", !test.unauth, test.unauth)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getOctoplusRewards error: %v", err)
+			}
+			if len(rewards) != test.want {
+				t.Errorf("got %d rewards, want %d", len(rewards), test.want)
+			}
+		})
+	}
+}
+
+func TestRenderEmailHTML(t *testing.T) {
+	var err error
+	emailTemplate, err = loadEmailTemplate("")
+	if err != nil {
+		t.Fatalf("loadEmailTemplate error: %v", err)
+	}
+
+	rewards := []OctoplusReward{{ID: 1, Vouchers: []OctoplusVoucher{{Code: "ABC123"}}}}
+
+	// Each email has its own attachment names, the template parsed at startup mustn't keep the first
+	for _, name := range []string{"first.png", "second.png"} {
+		html, err := renderEmailHTML(rewards, "", map[string]string{"ABC123": name})
+		if err != nil {
+			t.Fatalf("renderEmailHTML error: %v", err)
+		}
+		if !strings.Contains(html, "cid:"+name) {
+			t.Errorf("rendered email doesn't reference cid:%s", name)
+		}
+	}
+}
+
+func TestFetchRewards(t *testing.T) {
+	defer func(n int) { *jobs = n }(*jobs)
+	*jobs = 2
+
+	var running, peak int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		now := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+				break
+			}
+		}
+
+		var request GraphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		id := int(request.Variables["rewardId"].(float64))
+		if id == 999 {
+			w.Write([]byte(`{"errors":[{"message":"Reward not found"}]}`))
+			return
+		}
+
+		// Later IDs answer first, so the order can only come from -reward-id
+		time.Sleep(time.Duration(10-id) * 5 * time.Millisecond)
+		fmt.Fprintf(w, `{"data":{"octoplusRewards":[{"id":%d}]}}`, id)
+	})
+	client.Token = "abc123"
+
+	rewards, err := client.fetchRewards(context.Background(), []int{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatalf("fetchRewards error: %v", err)
+	}
+	var ids []int
+	for _, reward := range rewards {
+		ids = append(ids, reward.ID)
+	}
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" {
+		t.Errorf("fetchRewards returned rewards %v, want [1 2 3 4 5]", ids)
+	}
+	if peak != 2 {
+		t.Errorf("%d requests ran at once, want -jobs 2", peak)
+	}
+
+	_, err = client.fetchRewards(context.Background(), []int{1, 999, 3})
+	if err == nil || !strings.Contains(err.Error(), "reward 999") {
+		t.Errorf("fetchRewards error = %v, want reward 999 to fail the fetch", err)
+	}
+}
+
+func TestEmptyCodeVouchers(t *testing.T) {
+	rewards := dedupeVouchers([]OctoplusReward{{ID: 1, Vouchers: []OctoplusVoucher{
+		{BarcodeValue: "1111"},
+		{BarcodeValue: "2222"},
+		{BarcodeValue: "1111"},
+	}}})
+	if len(rewards) != 1 || len(rewards[0].Vouchers) != 2 {
+		t.Fatalf("dedupeVouchers = %+v, want the two distinct barcodes", rewards)
+	}
+
+	barcodes, err := generateBarcodesAs(rewards, "png")
+	if err != nil {
+		t.Fatalf("generateBarcodesAs error: %v", err)
+	}
+	if len(barcodes) != 2 || barcodes["1111"] == nil || barcodes["2222"] == nil {
+		t.Errorf("generateBarcodesAs keyed %d images, want one for each barcode value", len(barcodes))
+	}
+
+	names, err := attachmentNames(rewards)
+	if err != nil {
+		t.Fatalf("attachmentNames error: %v", err)
+	}
+	if len(names) != 2 || names["1111"] == names["2222"] {
+		t.Errorf("attachmentNames = %v, want a distinct name for each voucher", names)
+	}
+
+	// Notifying about the first mustn't mark the second as notified
+	state := &State{NotifiedVouchers: []string{"1111"}}
+	fresh := state.newVouchers(rewards)
+	if len(fresh) != 1 || len(fresh[0].Vouchers) != 1 || fresh[0].Vouchers[0].BarcodeValue != "2222" {
+		t.Errorf("newVouchers = %+v, want only the 2222 voucher", fresh)
+	}
+}
+
+// roundTripFunc lets a function stand in for the network under DebugTransport
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDebugTransportMasksWithoutRedact(t *testing.T) {
+	defer func(value bool) { *redact = value }(*redact)
+	*redact = false
+
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	transport := &DebugTransport{Next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"data":{"obtainKrakenToken":{"token":"secret-response-token"}}}`)),
+		}, nil
+	})}
+
+	req := httptest.NewRequest(http.MethodPost, "https://api.octopus.energy/v1/graphql/", nil)
+	req.Header.Set("Authorization", "secret-request-token")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip error: %v", err)
+	}
+
+	// The caller still gets the real body
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "secret-response-token") {
+		t.Errorf("response body = %s, want it unchanged", body)
+	}
+
+	for _, secret := range []string{"secret-request-token", "secret-response-token"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("-http-debug logged %s with -redact=false:\n%s", secret, logs.String())
+		}
+	}
+}
+
+func TestFormatExpiryAt(t *testing.T) {
+	defer func(loc *time.Location) { displayLocation = loc }(displayLocation)
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	displayLocation = london
+
+	// 20:00 on a summer evening in London
+	now := time.Date(2024, 6, 10, 20, 0, 0, 0, london)
+
+	tests := []struct {
+		expiresAt string
+		want      string
+	}{
+		{"2024-06-10T18:00:00Z", "Mon 10 Jun 2024 19:00 BST (expired)"},
+		{"2024-06-10T22:30:00Z", "Mon 10 Jun 2024 23:30 BST (expires today)"},
+		// Either side of midnight, less than a day away
+		{"2024-06-10T22:59:00Z", "Mon 10 Jun 2024 23:59 BST (expires today)"},
+		{"2024-06-10T23:00:00Z", "Tue 11 Jun 2024 00:00 BST (expires in 1 day)"},
+		{"2024-06-11T08:00:00Z", "Tue 11 Jun 2024 09:00 BST (expires in 1 day)"},
+		// More than two days of hours, but only two midnights
+		{"2024-06-12T22:00:00Z", "Wed 12 Jun 2024 23:00 BST (expires in 2 days)"},
+		{"2024-06-13T08:00:00Z", "Thu 13 Jun 2024 09:00 BST (expires in 3 days)"},
+		// The clocks going back in October doesn't skew the count
+		{"2024-10-28T09:00:00Z", "Mon 28 Oct 2024 09:00 GMT (expires in 140 days)"},
+		{"not a date", "not a date"},
+	}
+
+	for _, test := range tests {
+		if got := formatExpiryAt(test.expiresAt, now); got != test.want {
+			t.Errorf("formatExpiryAt(%q) = %q, want %q", test.expiresAt, got, test.want)
+		}
+	}
+}